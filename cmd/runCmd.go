@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
 	"path"
+	"strings"
 	"syscall"
 	"time"
 
@@ -16,48 +18,203 @@ import (
 // User input variables
 var verbose bool
 var configFile string
+var drainTimeout time.Duration
+var declarative bool
+var interval time.Duration
+var watch bool
+var remoteToken string
+var remoteHeaders []string
+var remoteCert string
+var remoteKey string
+var remoteCA string
+var streamURL string
+var streamIdleTimeout time.Duration
+var cacheFile string
+var trustedKeys []string
+var secretDirs []string
+var secretEnv []string
+var overrideFile string
+var metricsAddress string
+var adminAddress string
+var adminToken string
 
-func runCmd() *cobra.Command {
-	// init zap logger
-	logger, err := zap.NewProduction()
-	if err != nil {
-		log.Fatalf("Error initializing logger: %v", err)
+// init zap logger from config document log settings
+func newLogger(settings marijan.LogSettings) (*zap.Logger, error) {
+	config := zap.NewProductionConfig()
+
+	if settings.Level != "" {
+		level, err := zap.ParseAtomicLevel(settings.Level)
+		if err != nil {
+			return nil, err
+		}
+		config.Level = level
 	}
-	defer logger.Sync()
 
+	if settings.Format != "" {
+		config.Encoding = settings.Format
+	}
+
+	return config.Build()
+}
+
+func runCmd() *cobra.Command {
 	var runCmd = &cobra.Command{
 		Use:   "run",
 		Short: "Run marijan tunnel client",
 		Run: func(cmd *cobra.Command, args []string) {
-			manager := marijan.NewManager(
+			// manager settings from config document, flags set by user take precedence
+			// http(s) config is fetched from remote config source
+			source := marijan.ConfigSourceFile
+			if strings.HasPrefix(configFile, "http://") || strings.HasPrefix(configFile, "https://") {
+				source = marijan.ConfigSourceRemote
+			}
+
+			var settings marijan.ManagerSettings
+			var settingsErr error
+			if source == marijan.ConfigSourceFile {
+				settings, settingsErr = marijan.ReadSettings(configFile)
+			}
+
+			logger, err := newLogger(settings.Log)
+			if err != nil {
+				log.Fatalf("Error initializing logger: %v", err)
+			}
+			defer logger.Sync()
+
+			if settingsErr != nil {
+				logger.Warn("Error reading manager settings, using flags and defaults", zap.Error(settingsErr))
+			}
+
+			if !cmd.Flags().Changed("verbose") && settings.Log.Level == "debug" {
+				verbose = true
+			}
+			if !cmd.Flags().Changed("interval") && settings.Interval > 0 {
+				interval = time.Duration(settings.Interval)
+			}
+			if !cmd.Flags().Changed("drain-timeout") && settings.DrainTimeout > 0 {
+				drainTimeout = time.Duration(settings.DrainTimeout)
+			}
+			if !cmd.Flags().Changed("declarative") && settings.Declarative {
+				declarative = true
+			}
+			if !cmd.Flags().Changed("metrics-address") && settings.Metrics.Address != "" {
+				metricsAddress = settings.Metrics.Address
+			}
+			if !cmd.Flags().Changed("admin-address") && settings.Admin.Address != "" {
+				adminAddress = settings.Admin.Address
+			}
+			if !cmd.Flags().Changed("admin-token") && settings.Admin.Token != "" {
+				adminToken = settings.Admin.Token
+			}
+
+			// token from environment keeps it out of process list
+			if remoteToken == "" {
+				remoteToken = os.Getenv("MARIJAN_REMOTE_TOKEN")
+			}
+			if adminToken == "" {
+				adminToken = os.Getenv("MARIJAN_ADMIN_TOKEN")
+			}
+
+			opts := []marijan.ManagerOpt{
+				marijan.WithRemoteToken(remoteToken),
+				marijan.WithRemoteClientCert(remoteCert, remoteKey),
+				marijan.WithRemoteCA(remoteCA),
+				marijan.WithVersion(currentVersion),
+				marijan.WithStream(streamURL),
+				marijan.WithStreamIdleTimeout(streamIdleTimeout),
+				marijan.WithCache(cacheFile),
+				marijan.WithRemoteSecretDirs(secretDirs...),
+				marijan.WithRemoteSecretEnv(secretEnv...),
+			}
+			for _, header := range remoteHeaders {
+				name, value, ok := strings.Cut(header, ":")
+				if !ok || strings.TrimSpace(name) == "" {
+					logger.Fatal("Invalid remote header, expected \"Name: value\"", zap.String("header", header))
+				}
+				opts = append(opts, marijan.WithRemoteHeader(strings.TrimSpace(name), strings.TrimSpace(value)))
+			}
+
+			for _, text := range trustedKeys {
+				key, err := marijan.ParseTrustedKey(text)
+				if err != nil {
+					logger.Fatal("Invalid trusted key", zap.Error(err))
+				}
+				opts = append(opts, marijan.WithTrustedKeys(key))
+			}
+
+			// local overrides take precedence over config from --config
+			if overrideFile != "" {
+				opts = append(opts, marijan.WithProvider(marijan.NewOverrideProvider(overrideFile, watch)))
+			}
+
+			manager := marijan.NewManager(append(opts,
 				marijan.WithURL(configFile),
-				marijan.WithSource(marijan.ConfigSourceFile),
-				marijan.WithInterval(1*time.Second),
+				marijan.WithSource(source),
+				marijan.WithInterval(interval),
+				marijan.WithWatch(watch),
 				marijan.WithDebug(verbose),
 				marijan.WithLogger(logger),
-			)
+				marijan.WithDrainTimeout(drainTimeout),
+				marijan.WithDeclarative(declarative),
+				marijan.WithMetricsAddress(metricsAddress),
+				marijan.WithAdminAddress(adminAddress),
+				marijan.WithAdminToken(adminToken),
+			)...)
 
-			done := make(chan os.Signal, 1)
-			signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-			logger.Info("Starting tunnel client")
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+			defer stop()
+
+			// force config reload on SIGHUP
+			hangup := make(chan os.Signal, 1)
+			signal.Notify(hangup, syscall.SIGHUP)
+			defer signal.Stop(hangup)
 
-			manager.Start()
+			go func() {
+				for range hangup {
+					logger.Info("Received SIGHUP, reloading config")
+					manager.Reload()
+				}
+			}()
+
+			logger.Info("Starting tunnel client")
 
-			<-done
+			if err := manager.Run(ctx); err != nil {
+				logger.Fatal("Error running tunnel client", zap.Error(err))
+			}
 
-			logger.Info("Stopping tunnel client")
+			logger.Info("Tunnel client stopped")
 		},
 	}
 
 	// get default config path relative to home directory
-	defaultConfigPath, err := os.UserHomeDir()
+	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		logger.Error("Error getting user home directory: %v", zap.Error(err))
+		log.Printf("Error getting user home directory: %v", err)
 	}
-	defaultConfigPath = path.Join(defaultConfigPath, ".marijan/config.json")
+	defaultConfigPath := path.Join(homeDir, ".marijan/config.json")
+	defaultCachePath := path.Join(homeDir, ".marijan/remote-cache.json")
 
 	runCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose output")
-	runCmd.PersistentFlags().StringVarP(&configFile, "config", "c", defaultConfigPath, "Path to the config file")
+	runCmd.PersistentFlags().StringVarP(&configFile, "config", "c", defaultConfigPath, "Path to the config file, a directory of config files, a glob pattern or an http(s) URL of remote config")
+	runCmd.PersistentFlags().DurationVar(&interval, "interval", time.Second, "Interval to check tunnel connections and poll config")
+	runCmd.PersistentFlags().BoolVar(&watch, "watch", true, "Reload config file on change instead of polling it every interval")
+	runCmd.PersistentFlags().BoolVar(&declarative, "declarative", false, "Treat config as the full desired state, tunnels missing from it are stopped")
+	runCmd.PersistentFlags().DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "How long in-flight connections may finish on shutdown before they are closed")
+	runCmd.PersistentFlags().StringVar(&remoteToken, "remote-token", "", "Bearer token sent to remote config, defaults to MARIJAN_REMOTE_TOKEN environment variable")
+	runCmd.PersistentFlags().StringArrayVar(&remoteHeaders, "remote-header", nil, "Header sent to remote config as \"Name: value\", can be repeated")
+	runCmd.PersistentFlags().StringVar(&remoteCert, "remote-cert", "", "Client certificate file for mTLS with remote config")
+	runCmd.PersistentFlags().StringVar(&remoteKey, "remote-key", "", "Client key file for mTLS with remote config")
+	runCmd.PersistentFlags().StringVar(&remoteCA, "remote-ca", "", "CA bundle file used to verify remote config server")
+	runCmd.PersistentFlags().StringVar(&streamURL, "stream-url", "", "Server-sent events URL pushing remote config changes, remote config is polled while the stream is down")
+	runCmd.PersistentFlags().DurationVar(&streamIdleTimeout, "stream-idle-timeout", 90*time.Second, "Reconnect config stream when nothing, heartbeats included, is received for this long")
+	runCmd.PersistentFlags().StringVar(&cacheFile, "cache", defaultCachePath, "Cache file of last known good remote config, used when remote config is down on startup, empty to disable")
+	runCmd.PersistentFlags().StringArrayVar(&trustedKeys, "trusted-key", nil, "Ed25519 public key, base64 or ssh-ed25519 format, remote config must be signed by, can be repeated")
+	runCmd.PersistentFlags().StringArrayVar(&secretEnv, "secret-env", nil, "Environment variable ${VAR} placeholders of remote config may read, can be repeated")
+	runCmd.PersistentFlags().StringArrayVar(&secretDirs, "secret-dir", nil, "Directory ${file:...} placeholders of remote config may read secret files from, can be repeated")
+	runCmd.PersistentFlags().StringVar(&metricsAddress, "metrics-address", "", "Address serving prometheus metrics on /metrics, such as localhost:9100, empty to disable")
+	runCmd.PersistentFlags().StringVar(&adminAddress, "admin-address", "", "Loopback address, such as localhost:9101, or unix socket path serving admin API, empty to disable")
+	runCmd.PersistentFlags().StringVar(&adminToken, "admin-token", "", "Bearer token required by admin API, defaults to MARIJAN_ADMIN_TOKEN environment variable")
+	runCmd.PersistentFlags().StringVar(&overrideFile, "override", "", "Local config file, directory or glob pattern overriding fields of tunnels from --config")
 
 	return runCmd
 }
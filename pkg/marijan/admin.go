@@ -0,0 +1,176 @@
+package marijan
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// check if admin address is a unix socket path
+func isUnixSocket(address string) bool {
+	return strings.HasPrefix(address, "/")
+}
+
+// listen on admin address, a unix socket is only accessible by its owner. TCP address must be a
+// loopback address and requires a token.
+func listenAdmin(address string, token string) (net.Listener, error) {
+	if isUnixSocket(address) {
+		if info, err := os.Lstat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			// socket of a running instance must not be taken over
+			if conn, err := net.DialTimeout("unix", address, time.Second); err == nil {
+				conn.Close()
+				return nil, errors.New("another instance is serving admin API on this socket")
+			}
+
+			// socket left behind by a previous process
+			os.Remove(address)
+		}
+
+		return listenPrivateUnix(address)
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("host %s is not a loopback address, use localhost or a unix socket", host)
+	}
+	if token == "" {
+		return nil, errors.New("token is required when listening on TCP")
+	}
+
+	return net.Listen("tcp", address)
+}
+
+// AdminHandler returns handler of admin API, to mount it on an existing HTTP server instead of
+// WithAdminAddress. Requests must send token as bearer token when token is not empty.
+func (manager *Manager) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /tunnels", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, manager.Status())
+	})
+	mux.HandleFunc("GET /config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, manager.GetCurrentConfigs())
+	})
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, r *http.Request) {
+		manager.Reload()
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "reloading"})
+	})
+
+	actions := map[string]func(string) error{
+		"reconnect": manager.Reconnect,
+		"pause":     manager.Pause,
+		"resume":    manager.Resume,
+	}
+	mux.HandleFunc("POST /tunnels/{id}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		action, ok := actions[r.PathValue("action")]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("Unknown action %s", r.PathValue("action"))})
+			return
+		}
+		if _, ok := manager.GetTunnel(id); !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("Tunnel %s not found", id)})
+			return
+		}
+		if err := action(id); err != nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, manager.tunnelStatus(id))
+	})
+
+	if token == "" {
+		return mux
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "Invalid admin token"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// get status of a single tunnel
+func (manager *Manager) tunnelStatus(id string) TunnelStatus {
+	for _, status := range manager.Status() {
+		if status.ID == id {
+			return status
+		}
+	}
+
+	return TunnelStatus{ID: id}
+}
+
+// write value as JSON response
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(value)
+}
+
+// listen on admin address, nothing is served when address is empty
+func (manager *Manager) listenAdmin() error {
+	if manager.adminAddress == "" {
+		return nil
+	}
+
+	listener, err := listenAdmin(manager.adminAddress, manager.adminToken)
+	if err != nil {
+		return fmt.Errorf("Error listening admin API on %s: %v", manager.adminAddress, err)
+	}
+
+	manager.adminListener = listener
+
+	return nil
+}
+
+// serve admin API once config is loaded
+func (manager *Manager) serveAdmin() {
+	if manager.adminListener == nil {
+		return
+	}
+
+	server := &http.Server{Handler: manager.AdminHandler(manager.adminToken), ReadHeaderTimeout: 10 * time.Second}
+	listener := manager.adminListener
+	manager.adminServer = server
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			manager.logger().Error("Error serving admin API", zap.Error(err))
+		}
+	}()
+
+	manager.logger().Info(fmt.Sprintf("Serving admin API on %s", listener.Addr()))
+}
+
+// stop serving admin API
+func (manager *Manager) closeAdmin() {
+	if manager.adminServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		manager.adminServer.Shutdown(ctx)
+	} else if manager.adminListener != nil {
+		manager.adminListener.Close()
+	}
+
+	manager.adminServer = nil
+	manager.adminListener = nil
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package marijan
+
+import (
+	"net"
+	"os"
+)
+
+// listen on unix socket only accessible by its owner
+func listenPrivateUnix(address string) (net.Listener, error) {
+	listener, err := net.Listen("unix", address)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(address, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
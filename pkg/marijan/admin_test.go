@@ -0,0 +1,198 @@
+package marijan
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devetek/tuman/pkg/tukiran"
+)
+
+// send admin API request with token, returns status code and body
+func adminRequest(t *testing.T, server *httptest.Server, method string, path string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, server.URL+path, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+
+	return resp.StatusCode, string(body)
+}
+
+func TestAdminAPI_Control(t *testing.T) {
+	tunnel := testTunnel("web")
+	tunnel.Auth.Password = "hunter2"
+
+	manager := NewManager(WithProvider(staticProvider{tunnel}), WithInterval(time.Hour))
+	if err := manager.load(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer manager.connCancel()
+
+	server := httptest.NewServer(manager.AdminHandler("secret"))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/tunnels")
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected request without token to be rejected, got %d", resp.StatusCode)
+	}
+
+	code, body := adminRequest(t, server, http.MethodGet, "/tunnels")
+	var statuses []TunnelStatus
+	if err := json.Unmarshal([]byte(body), &statuses); code != http.StatusOK || err != nil || len(statuses) != 1 || statuses[0].ID != "web" {
+		t.Fatalf("Expected status of web tunnel, got %d %s", code, body)
+	}
+
+	code, body = adminRequest(t, server, http.MethodGet, "/config")
+	if code != http.StatusOK || strings.Contains(body, "hunter2") || !strings.Contains(body, secretMask) {
+		t.Fatalf("Expected masked config, got %d %s", code, body)
+	}
+
+	code, body = adminRequest(t, server, http.MethodPost, "/tunnels/web/pause")
+	if code != http.StatusOK || !strings.Contains(body, `"state":"Paused"`) {
+		t.Fatalf("Expected paused tunnel, got %d %s", code, body)
+	}
+
+	// paused tunnel stays closed across config reloads and cannot be reconnected
+	manager.apply(manager.fetchProviders(context.Background(), true))
+	if config, _ := manager.GetTunnel("web"); config.connection != nil {
+		t.Fatalf("Expected paused tunnel to stay closed after reload")
+	}
+	if code, body = adminRequest(t, server, http.MethodPost, "/tunnels/web/reconnect"); code != http.StatusConflict {
+		t.Fatalf("Expected paused tunnel reconnect to be rejected, got %d %s", code, body)
+	}
+
+	code, body = adminRequest(t, server, http.MethodPost, "/tunnels/web/resume")
+	if config, _ := manager.GetTunnel("web"); code != http.StatusOK || config.connection == nil {
+		t.Fatalf("Expected resumed tunnel to connect, got %d %s", code, body)
+	}
+
+	if code, body = adminRequest(t, server, http.MethodPost, "/tunnels/web/reconnect"); code != http.StatusOK {
+		t.Fatalf("Expected reconnect, got %d %s", code, body)
+	}
+	if code, body = adminRequest(t, server, http.MethodPost, "/tunnels/missing/pause"); code != http.StatusNotFound {
+		t.Fatalf("Expected unknown tunnel to be not found, got %d %s", code, body)
+	}
+	if code, body = adminRequest(t, server, http.MethodPost, "/reload"); code != http.StatusAccepted {
+		t.Fatalf("Expected reload to be accepted, got %d %s", code, body)
+	}
+}
+
+func TestListenAdmin(t *testing.T) {
+	if _, err := listenAdmin("0.0.0.0:0", "secret"); err == nil {
+		t.Fatalf("Expected non-loopback address to be rejected")
+	}
+	if _, err := listenAdmin("127.0.0.1:0", ""); err == nil {
+		t.Fatalf("Expected TCP address without token to be rejected")
+	}
+
+	listener, err := listenAdmin("localhost:0", "secret")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	listener.Close()
+
+	// unix socket is only accessible by its owner
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	listener, err = listenAdmin(socket, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	info, err := os.Stat(socket)
+	if err != nil || info.Mode().Perm()&0077 != 0 {
+		t.Fatalf("Expected socket only accessible by owner, got %v (%v)", info.Mode(), err)
+	}
+
+	// socket of a running instance is not taken over
+	if _, err := listenAdmin(socket, ""); err == nil {
+		t.Fatalf("Expected socket of running instance to be refused")
+	}
+
+	// stale socket left behind by a previous process is replaced
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	listener, err = listenAdmin(socket, "")
+	if err != nil {
+		t.Fatalf("Expected stale socket to be replaced, got %v", err)
+	}
+	listener.Close()
+}
+
+func TestAdminAPI_PauseAndReconnectWhileConnecting(t *testing.T) {
+	config := forwardedTunnel(t, "web", startDelayedTunnelServer(t, 300*time.Millisecond))
+	manager := NewManager(WithProvider(staticProvider{config}), WithInterval(time.Hour))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- manager.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-result
+	}()
+
+	connecting := func() *tukiran.TunnelForwarder {
+		var connection *tukiran.TunnelForwarder
+		waitFor(t, "connection to dial", func() bool {
+			current, _ := manager.GetTunnel("web")
+			connection = current.connection
+			return connection != nil && connection.GetState() == tukiran.Connecting
+		})
+		return connection
+	}
+
+	// paused tunnel must not finish its handshake and serve
+	old := connecting()
+	if err := manager.Pause("web"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if old.GetState() != tukiran.Closed {
+		t.Fatalf("Expected paused connection to be closed, got %s", old.GetStateString())
+	}
+	if conn, err := net.DialTimeout("tcp", "127.0.0.1:"+config.ListenerPort, time.Second); err == nil {
+		conn.Close()
+		t.Fatalf("Expected paused tunnel not to serve")
+	}
+
+	// reconnect mid-dial leaves a single forwarder serving
+	if err := manager.Resume("web"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	old = connecting()
+	if err := manager.Reconnect("web"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	current, _ := manager.GetTunnel("web")
+	waitFor(t, "new connection to connect", func() bool {
+		return current.connection.GetState() == tukiran.Connected
+	})
+	time.Sleep(500 * time.Millisecond)
+	if old.GetState() != tukiran.Closed || current.connection.GetState() != tukiran.Connected {
+		t.Fatalf("Expected old connection closed and new one serving, got %s and %s", old.GetStateString(), current.connection.GetStateString())
+	}
+}
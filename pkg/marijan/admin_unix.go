@@ -0,0 +1,24 @@
+//go:build unix
+
+package marijan
+
+import (
+	"net"
+	"sync"
+	"syscall"
+)
+
+// serializes umask changes of concurrent listeners, umask is process wide
+var umaskMu sync.Mutex
+
+// listen on unix socket only accessible by its owner, socket is created with owner-only
+// permission so it is never reachable with default umask
+func listenPrivateUnix(address string) (net.Listener, error) {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+
+	previous := syscall.Umask(0077)
+	defer syscall.Umask(previous)
+
+	return net.Listen("unix", address)
+}
@@ -0,0 +1,191 @@
+package marijan
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/devetek/tuman/pkg/tukiran"
+	"golang.org/x/crypto/ssh"
+)
+
+// AuthConfig holds credentials used to authenticate to the tunnel server
+type AuthConfig struct {
+	PrivateKeyFile      string `json:"private_key_file,omitempty"`
+	CertificateFile     string `json:"certificate_file,omitempty"`
+	PrivateKey          string `json:"private_key,omitempty"`
+	Passphrase          string `json:"passphrase,omitempty"`
+	Password            string `json:"password,omitempty"`
+	KeyboardInteractive bool   `json:"keyboard_interactive,omitempty"`
+	Agent               bool   `json:"agent,omitempty"`
+	AgentSocket         string `json:"agent_socket,omitempty"`
+	AgentIdentity       string `json:"agent_identity,omitempty"`
+}
+
+// expand leading `~` to the user home directory
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
+
+// parse PEM private key, decrypt it when passphrase is set
+func parsePrivateKey(pemBytes []byte, passphrase string) (ssh.Signer, error) {
+	if passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+	}
+
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if err != nil {
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return nil, errors.New("private key is encrypted but no passphrase is set")
+		}
+		return nil, err
+	}
+
+	return signer, nil
+}
+
+// read OpenSSH user certificate (`-cert.pub`) from disk
+func (auth AuthConfig) certificate() (*ssh.Certificate, error) {
+	certBytes, err := os.ReadFile(expandHome(auth.CertificateFile))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading certificate file: %v", err)
+	}
+
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing certificate file %s: %v", auth.CertificateFile, err)
+	}
+
+	cert, ok := publicKey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("File %s is not an SSH certificate", auth.CertificateFile)
+	}
+
+	return cert, nil
+}
+
+// get signers from private key file and inline PEM
+func (auth AuthConfig) signers() ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+
+	if auth.PrivateKeyFile != "" {
+		pemBytes, err := os.ReadFile(expandHome(auth.PrivateKeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("Error reading private key file: %v", err)
+		}
+
+		signer, err := parsePrivateKey(pemBytes, auth.Passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing private key file %s: %v", auth.PrivateKeyFile, err)
+		}
+		signers = append(signers, signer)
+	}
+
+	if auth.PrivateKey != "" {
+		signer, err := parsePrivateKey([]byte(auth.PrivateKey), auth.Passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing inline private key: %v", err)
+		}
+		signers = append(signers, signer)
+	}
+
+	// present certificate first, the plain key stays as fallback
+	if auth.CertificateFile != "" {
+		if len(signers) == 0 {
+			return nil, errors.New("certificate file requires a private key")
+		}
+
+		cert, err := auth.certificate()
+		if err != nil {
+			return nil, err
+		}
+
+		certSigner, err := ssh.NewCertSigner(cert, signers[0])
+		if err != nil {
+			return nil, fmt.Errorf("Error creating certificate signer: %v", err)
+		}
+		signers = append([]ssh.Signer{certSigner}, signers...)
+	}
+
+	return signers, nil
+}
+
+// answer every keyboard-interactive question with the configured password
+func (auth AuthConfig) keyboardInteractive() ssh.KeyboardInteractiveChallenge {
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for index := range questions {
+			answers[index] = auth.Password
+		}
+		return answers, nil
+	}
+}
+
+// get ssh-agent auth when enabled, socket defaults to SSH_AUTH_SOCK
+func (auth AuthConfig) agentAuth() *tukiran.AgentAuth {
+	if !auth.Agent {
+		return nil
+	}
+
+	socket := auth.AgentSocket
+	if socket != "" {
+		socket = expandHome(socket)
+	}
+
+	return tukiran.NewAgentAuth(socket, auth.AgentIdentity)
+}
+
+// get ssh authentication methods, ordered from the strongest to the weakest
+func (auth AuthConfig) authMethods(agentAuth *tukiran.AgentAuth) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+
+	// validate keys early, they are read again from disk on every handshake
+	signers, err := auth.signers()
+	if err != nil {
+		return nil, err
+	}
+
+	// ssh client tries public key method only once, agent and file keys must share it
+	if agentAuth != nil || len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			signers, err := auth.signers()
+			if err != nil {
+				return nil, err
+			}
+			if agentAuth == nil {
+				return signers, nil
+			}
+
+			agentSigners, err := agentAuth.Signers()
+			if err != nil {
+				if len(signers) > 0 {
+					return signers, nil
+				}
+				return nil, err
+			}
+			return append(agentSigners, signers...), nil
+		}))
+	}
+
+	if auth.Password != "" {
+		methods = append(methods, ssh.Password(auth.Password))
+	}
+
+	if auth.KeyboardInteractive {
+		methods = append(methods, ssh.KeyboardInteractive(auth.keyboardInteractive()))
+	}
+
+	return methods, nil
+}
@@ -0,0 +1,308 @@
+package marijan
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devetek/tuman/pkg/tukiran"
+	gliderssh "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+func generateKeyPEM(t *testing.T, passphrase string) []byte {
+	t.Helper()
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	var block *pem.Block
+	if passphrase != "" {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(privateKey, "", []byte(passphrase))
+	} else {
+		block, err = ssh.MarshalPrivateKey(privateKey, "")
+	}
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	return pem.EncodeToMemory(block)
+}
+
+func TestAuthMethods_AllCredentials(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, generateKeyPEM(t, ""), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+
+	auth := AuthConfig{
+		PrivateKeyFile:      keyFile,
+		Password:            "secret",
+		KeyboardInteractive: true,
+	}
+
+	methods, err := auth.authMethods(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(methods) != 3 {
+		t.Fatalf("Expected 3 auth methods, got %d", len(methods))
+	}
+}
+
+func TestAuthMethods_EncryptedKey(t *testing.T) {
+	auth := AuthConfig{PrivateKey: string(generateKeyPEM(t, "passphrase"))}
+
+	if _, err := auth.authMethods(nil); err == nil {
+		t.Fatalf("Expected error for encrypted key without passphrase")
+	}
+
+	auth.Passphrase = "passphrase"
+	methods, err := auth.authMethods(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(methods) != 1 {
+		t.Fatalf("Expected 1 auth method, got %d", len(methods))
+	}
+}
+
+func TestSigners_Certificate(t *testing.T) {
+	dir := t.TempDir()
+	keyPEM := generateKeyPEM(t, "")
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(keyPEM)
+	if err != nil {
+		t.Fatalf("Failed to parse key: %v", err)
+	}
+	caSigner, err := ssh.ParsePrivateKey(generateKeyPEM(t, ""))
+	if err != nil {
+		t.Fatalf("Failed to parse CA key: %v", err)
+	}
+
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"marijan"},
+		ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatalf("Failed to sign certificate: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "id_ed25519-cert.pub")
+	if err := os.WriteFile(certFile, ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		t.Fatalf("Failed to write certificate file: %v", err)
+	}
+
+	auth := AuthConfig{PrivateKeyFile: keyFile, CertificateFile: certFile}
+	signers, err := auth.signers()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(signers) != 2 {
+		t.Fatalf("Expected certificate and key signers, got %d", len(signers))
+	}
+	if _, ok := signers[0].PublicKey().(*ssh.Certificate); !ok {
+		t.Fatalf("Expected certificate signer to be presented first")
+	}
+}
+
+// serve tunnel server configured by setup, returns its port
+func startAuthTunnelServer(t *testing.T, setup func(*gliderssh.Server)) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	server := newTunnelServer()
+	setup(server)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// run manager with config until the tunnel reaches Connected or fails
+func runAuthTunnel(t *testing.T, config Config) tukiran.ConnectionState {
+	t.Helper()
+
+	manager := NewManager(WithProvider(staticProvider{config}), WithInterval(time.Hour))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- manager.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-result
+	}()
+
+	var state tukiran.ConnectionState
+	waitFor(t, "connection to connect or fail", func() bool {
+		current, _ := manager.GetTunnel(config.ID)
+		if current.connection == nil {
+			return false
+		}
+		state = current.connection.GetState()
+		return state == tukiran.Connected || state == tukiran.Error
+	})
+
+	return state
+}
+
+func TestAuth_Password(t *testing.T) {
+	port := startAuthTunnelServer(t, func(server *gliderssh.Server) {
+		server.PasswordHandler = func(ctx gliderssh.Context, password string) bool {
+			return ctx.User() == "marijan" && password == "secret"
+		}
+	})
+
+	config := forwardedTunnel(t, "password", port)
+	config.TunnelUser = "marijan"
+	config.Auth = AuthConfig{Password: "secret"}
+	if state := runAuthTunnel(t, config); state != tukiran.Connected {
+		t.Fatalf("Expected password auth to connect, got state %d", state)
+	}
+
+	config.Auth.Password = "wrong"
+	if state := runAuthTunnel(t, config); state != tukiran.Error {
+		t.Fatalf("Expected wrong password to be rejected, got state %d", state)
+	}
+}
+
+func TestAuth_KeyboardInteractiveAnswersPassword(t *testing.T) {
+	port := startAuthTunnelServer(t, func(server *gliderssh.Server) {
+		// password method is not offered, only keyboard-interactive
+		server.KeyboardInteractiveHandler = func(ctx gliderssh.Context, challenge ssh.KeyboardInteractiveChallenge) bool {
+			answers, err := challenge("", "", []string{"Password: "}, []bool{false})
+			return err == nil && len(answers) == 1 && answers[0] == "secret"
+		}
+	})
+
+	config := forwardedTunnel(t, "interactive", port)
+	config.Auth = AuthConfig{Password: "secret", KeyboardInteractive: true}
+	if state := runAuthTunnel(t, config); state != tukiran.Connected {
+		t.Fatalf("Expected keyboard-interactive auth to connect, got state %d", state)
+	}
+}
+
+func TestAuth_PrivateKey(t *testing.T) {
+	// encrypted keys are covered by TestAuthMethods_EncryptedKey, their KDF is slow
+	keyPEM := generateKeyPEM(t, "")
+	signer, err := ssh.ParsePrivateKey(keyPEM)
+	if err != nil {
+		t.Fatalf("Failed to parse key: %v", err)
+	}
+
+	port := startAuthTunnelServer(t, func(server *gliderssh.Server) {
+		server.PublicKeyHandler = func(ctx gliderssh.Context, key gliderssh.PublicKey) bool {
+			return gliderssh.KeysEqual(key, signer.PublicKey())
+		}
+	})
+
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+
+	config := forwardedTunnel(t, "key", port)
+	config.Auth = AuthConfig{PrivateKeyFile: keyFile}
+	if state := runAuthTunnel(t, config); state != tukiran.Connected {
+		t.Fatalf("Expected key auth to connect, got state %d", state)
+	}
+
+	// a key the server does not accept is rejected
+	config.Auth = AuthConfig{PrivateKey: string(generateKeyPEM(t, ""))}
+	if state := runAuthTunnel(t, config); state != tukiran.Error {
+		t.Fatalf("Expected unknown key to be rejected, got state %d", state)
+	}
+}
+
+func TestAuth_CertificateFirst(t *testing.T) {
+	dir := t.TempDir()
+
+	keyPEM := generateKeyPEM(t, "")
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(keyPEM)
+	if err != nil {
+		t.Fatalf("Failed to parse key: %v", err)
+	}
+	caSigner, err := ssh.ParsePrivateKey(generateKeyPEM(t, ""))
+	if err != nil {
+		t.Fatalf("Failed to parse CA key: %v", err)
+	}
+
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"marijan"},
+		ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatalf("Failed to sign certificate: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "id_ed25519-cert.pub")
+	if err := os.WriteFile(certFile, ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		t.Fatalf("Failed to write certificate file: %v", err)
+	}
+
+	// server only trusts the user CA and records which key was offered first
+	var mu sync.Mutex
+	var offered []gliderssh.PublicKey
+	checker := &ssh.CertChecker{}
+	port := startAuthTunnelServer(t, func(server *gliderssh.Server) {
+		server.PublicKeyHandler = func(ctx gliderssh.Context, key gliderssh.PublicKey) bool {
+			mu.Lock()
+			offered = append(offered, key)
+			mu.Unlock()
+
+			cert, ok := key.(*ssh.Certificate)
+			return ok && cert.CertType == ssh.UserCert &&
+				gliderssh.KeysEqual(cert.SignatureKey, caSigner.PublicKey()) &&
+				checker.CheckCert(ctx.User(), cert) == nil
+		}
+	})
+
+	config := forwardedTunnel(t, "certificate", port)
+	config.TunnelUser = "marijan"
+	config.Auth = AuthConfig{PrivateKeyFile: keyFile, CertificateFile: certFile}
+	if state := runAuthTunnel(t, config); state != tukiran.Connected {
+		t.Fatalf("Expected certificate auth to connect, got state %d", state)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(offered) == 0 {
+		t.Fatalf("Expected a key to be offered")
+	}
+	if _, ok := offered[0].(*ssh.Certificate); !ok {
+		t.Fatalf("Expected certificate to be offered before the plain key, got %s", offered[0].Type())
+	}
+}
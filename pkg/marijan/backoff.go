@@ -0,0 +1,117 @@
+package marijan
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// cap of reconnect delay when max is not set
+const defaultBackoffMax = 2 * time.Minute
+
+// reconnect state of a tunnel, retry delay grows exponentially with full jitter
+type reconnectState struct {
+	attempts       int
+	nextRetry      time.Time
+	connectedSince time.Time
+	// retry of current attempt is scheduled from the time its failure was seen
+	scheduled bool
+	// next retry of current attempt is logged
+	announced bool
+}
+
+// backoff settings, zero values fall back to manager settings
+type backoff struct {
+	initial    time.Duration
+	max        time.Duration
+	resetAfter time.Duration
+}
+
+// get backoff settings for config, tunnel values override manager values
+func (manager *Manager) backoffFor(config Config) backoff {
+	b := backoff{
+		initial:    manager.backoffInitial,
+		max:        manager.backoffMax,
+		resetAfter: manager.backoffResetAfter,
+	}
+
+	if config.ReconnectInitial > 0 {
+		b.initial = time.Duration(config.ReconnectInitial)
+	}
+	if config.ReconnectMax > 0 {
+		b.max = time.Duration(config.ReconnectMax)
+	}
+	if config.ReconnectResetAfter > 0 {
+		b.resetAfter = time.Duration(config.ReconnectResetAfter)
+	}
+
+	return b
+}
+
+// get capped exponential delay for attempt, max not set uses defaultBackoffMax
+func (b backoff) ceiling(attempts int) time.Duration {
+	if b.initial <= 0 {
+		return 0
+	}
+
+	limit := b.max
+	if limit <= 0 {
+		limit = defaultBackoffMax
+	}
+
+	capped := b.initial
+	for i := 1; i < attempts && capped < limit; i++ {
+		capped *= 2
+	}
+
+	return min(capped, limit)
+}
+
+// get random delay between zero and capped exponential delay for attempt
+func (b backoff) delay(attempts int) time.Duration {
+	capped := b.ceiling(attempts)
+	if capped <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int64N(int64(capped) + 1))
+}
+
+// record connection attempt, its retry is scheduled once the attempt fails
+func (state *reconnectState) attempt(now time.Time) {
+	state.attempts++
+	state.connectedSince = time.Time{}
+	state.scheduled = false
+	state.announced = false
+}
+
+// record failure of current attempt or connection and schedule the next allowed retry,
+// a connection that dropped after a while waits like a failed dial
+func (state *reconnectState) failed(b backoff, now time.Time) {
+	if state.scheduled {
+		return
+	}
+
+	state.scheduled = true
+	state.connectedSince = time.Time{}
+	state.nextRetry = now.Add(b.delay(state.attempts))
+}
+
+// record connection is up, reset attempts once it stays up long enough
+func (state *reconnectState) connected(b backoff, now time.Time) {
+	if state.connectedSince.IsZero() {
+		state.connectedSince = now
+	}
+	// next failure is scheduled from when it is seen
+	state.scheduled = false
+	state.announced = false
+
+	if state.attempts > 0 && now.Sub(state.connectedSince) >= b.resetAfter {
+		state.attempts = 0
+		state.nextRetry = time.Time{}
+	}
+}
+
+// check if reconnect is allowed at the given time
+func (state *reconnectState) ready(now time.Time) bool {
+	return !now.Before(state.nextRetry)
+}
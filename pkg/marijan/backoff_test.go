@@ -0,0 +1,138 @@
+package marijan
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestBackoff_DelayCapped(t *testing.T) {
+	b := backoff{initial: time.Second, max: 8 * time.Second}
+
+	for attempts := 1; attempts <= 64; attempts++ {
+		delay := b.delay(attempts)
+		if delay < 0 || delay > 8*time.Second {
+			t.Fatalf("Delay %s for attempt %d is out of range", delay, attempts)
+		}
+	}
+}
+
+func TestBackoff_DelayNonDecreasing(t *testing.T) {
+	for _, test := range []struct {
+		backoff backoff
+		limit   time.Duration
+	}{
+		{backoff{initial: time.Second, max: 8 * time.Second}, 8 * time.Second},
+		// max not set falls back to default cap instead of staying at initial
+		{backoff{initial: time.Second}, defaultBackoffMax},
+	} {
+		previous := time.Duration(0)
+		for attempts := 1; attempts <= 64; attempts++ {
+			ceiling := test.backoff.ceiling(attempts)
+			if ceiling < previous {
+				t.Fatalf("Delay cap %s for attempt %d is below previous %s", ceiling, attempts, previous)
+			}
+			previous = ceiling
+		}
+
+		if test.backoff.ceiling(2) != 2*time.Second || test.backoff.ceiling(3) != 4*time.Second {
+			t.Fatalf("Expected delay to grow exponentially, got %s and %s", test.backoff.ceiling(2), test.backoff.ceiling(3))
+		}
+		if previous != test.limit {
+			t.Fatalf("Expected delay capped at %s, got %s", test.limit, previous)
+		}
+	}
+}
+
+func TestReconnectState_ScheduledOnFailure(t *testing.T) {
+	b := backoff{initial: time.Minute, max: time.Minute, resetAfter: time.Hour}
+	dialed := time.Now()
+
+	var state reconnectState
+	state.attempt(dialed)
+	state.connected(b, dialed)
+
+	// connection drops after a while, retry waits from the drop and not from the dial
+	dropped := dialed.Add(10 * time.Minute)
+	state.failed(b, dropped)
+	if state.nextRetry.Before(dropped) {
+		t.Fatalf("Expected retry scheduled after failure at %s, got %s", dropped, state.nextRetry)
+	}
+
+	// failure is only scheduled once per attempt
+	nextRetry := state.nextRetry
+	state.failed(b, dropped.Add(time.Minute))
+	if !state.nextRetry.Equal(nextRetry) {
+		t.Fatalf("Expected retry to be kept, got %s", state.nextRetry)
+	}
+}
+
+func TestReconnectState_ResetAfterStable(t *testing.T) {
+	b := backoff{initial: time.Second, max: time.Minute, resetAfter: 10 * time.Second}
+	now := time.Now()
+
+	var state reconnectState
+	state.attempt(now)
+	state.failed(b, now)
+	state.attempt(now)
+	state.failed(b, now)
+	if state.attempts != 2 {
+		t.Fatalf("Expected 2 attempts, got %d", state.attempts)
+	}
+	if !state.ready(now.Add(2 * time.Second)) {
+		t.Fatalf("Expected retry to be allowed after capped delay")
+	}
+
+	state.connected(b, now)
+	state.connected(b, now.Add(5*time.Second))
+	if state.attempts != 2 {
+		t.Fatalf("Expected attempts kept before reset period, got %d", state.attempts)
+	}
+
+	state.connected(b, now.Add(10*time.Second))
+	if state.attempts != 0 {
+		t.Fatalf("Expected attempts reset after stable period, got %d", state.attempts)
+	}
+}
+
+func TestMaintain_LogsScheduledRetryOnce(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	// nothing listens on tunnel port, every dial fails
+	config := forwardedTunnel(t, "web", freePort(t))
+	manager := NewManager(
+		WithProvider(staticProvider{config}),
+		WithInterval(20*time.Millisecond),
+		WithBackoff(time.Hour, time.Hour),
+		WithLogger(zap.New(core)),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- manager.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-result
+	}()
+
+	scheduled := func() []observer.LoggedEntry {
+		return logs.FilterMessageSnippet("reconnect scheduled").AllUntimed()
+	}
+	waitFor(t, "reconnect to be scheduled", func() bool {
+		return len(scheduled()) > 0
+	})
+
+	// following checks while waiting for retry must not repeat it
+	time.Sleep(200 * time.Millisecond)
+	entries := scheduled()
+	if len(entries) != 1 {
+		t.Fatalf("Expected scheduled retry logged once, got %d", len(entries))
+	}
+	if _, ok := entries[0].ContextMap()["next_retry"].(time.Time); !ok {
+		t.Fatalf("Expected next_retry time in log, got %v", entries[0].ContextMap())
+	}
+}
@@ -0,0 +1,183 @@
+package marijan
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+type configFormat string
+
+const (
+	configFormatJSON configFormat = "json"
+	configFormatYAML configFormat = "yaml"
+	configFormatTOML configFormat = "toml"
+)
+
+// port fields may be written as numbers in YAML and TOML
+var portFields = []string{"tunnel_port", "listener_port", "service_port"}
+
+// get config format from file extension, JSON when unknown
+func formatFromPath(name string) configFormat {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".yaml", ".yml":
+		return configFormatYAML
+	case ".toml":
+		return configFormatTOML
+	}
+
+	return configFormatJSON
+}
+
+// get config format from HTTP Content-Type, empty when unknown
+func formatFromContentType(contentType string) configFormat {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+
+	switch mediaType {
+	case "application/json":
+		return configFormatJSON
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return configFormatYAML
+	case "application/toml", "text/toml":
+		return configFormatTOML
+	}
+
+	return ""
+}
+
+// parse config document to generic values
+func parseDocument(data []byte, format configFormat) (interface{}, error) {
+	var document interface{}
+
+	switch format {
+	case configFormatYAML:
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return nil, fmt.Errorf("Error unmarshalling YAML: %v", err)
+		}
+	case configFormatTOML:
+		// TOML document is always a table, tunnels are listed in [[tunnels]]
+		var table map[string]interface{}
+		if err := toml.Unmarshal(data, &table); err != nil {
+			return nil, fmt.Errorf("Error unmarshalling TOML: %v", err)
+		}
+		document = normalizeTOML(table)
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&document); err != nil {
+			return nil, fmt.Errorf("Error unmarshalling JSON: %v", err)
+		}
+	}
+
+	return document, nil
+}
+
+// convert TOML array of tables to generic list, like JSON and YAML decode them
+func normalizeTOML(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, item := range typed {
+			typed[key] = normalizeTOML(item)
+		}
+		return typed
+	case []map[string]interface{}:
+		list := make([]interface{}, 0, len(typed))
+		for _, item := range typed {
+			list = append(list, normalizeTOML(item))
+		}
+		return list
+	case []interface{}:
+		for index, item := range typed {
+			typed[index] = normalizeTOML(item)
+		}
+		return typed
+	}
+
+	return value
+}
+
+// decode tunnels of remote config document
+func decodeConfigs(data []byte, format configFormat, policy secretPolicy) ([]Config, error) {
+	document, err := decodeDocument(data, format, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return document.Tunnels, nil
+}
+
+// get tunnel entries from parsed document
+func tunnelEntries(document interface{}) ([]map[string]interface{}, error) {
+	list, ok := document.([]interface{})
+	if !ok {
+		table, isTable := document.(map[string]interface{})
+		if !isTable {
+			return nil, errors.New("config must be a list of tunnels")
+		}
+		if list, ok = table["tunnels"].([]interface{}); !ok {
+			if _, found := table["tunnels"]; found {
+				return nil, errors.New("tunnels: must be a list")
+			}
+			return nil, errors.New("config must be a list of tunnels")
+		}
+	}
+
+	entries := make([]map[string]interface{}, 0, len(list))
+	for index, item := range list {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("tunnel[%d]: must be an object", index)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// get readable name of tunnel entry for error messages
+func entryName(index int, entry map[string]interface{}) string {
+	if id, ok := entry["id"].(string); ok && id != "" {
+		return fmt.Sprintf("tunnel[%d] (id %q)", index, id)
+	}
+
+	return fmt.Sprintf("tunnel[%d]", index)
+}
+
+// convert numeric port fields to strings
+func normalizePorts(entry map[string]interface{}) {
+	for _, field := range portFields {
+		switch value := entry[field].(type) {
+		case int:
+			entry[field] = strconv.Itoa(value)
+		case int64:
+			entry[field] = strconv.FormatInt(value, 10)
+		case float64:
+			entry[field] = strconv.FormatFloat(value, 'f', -1, 64)
+		case json.Number:
+			entry[field] = value.String()
+		}
+	}
+}
+
+// decode single tunnel entry, unknown fields are rejected
+func decodeConfig(entry map[string]interface{}) (Config, error) {
+	var config Config
+
+	normalizePorts(entry)
+	if err := decodeStrict(entry, &config); err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
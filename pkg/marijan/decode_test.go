@@ -0,0 +1,146 @@
+package marijan
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeConfigs_Formats(t *testing.T) {
+	yamlConfig := `
+- id: yaml-tunnel
+  tunnel_host: tunnel.beta.devetek.app
+  tunnel_port: 2220
+  listener_host: 0.0.0.0
+  listener_port: 3001
+  service_host: localhost
+  service_port: 3000
+  keepalive_interval: 30s
+  state: active
+`
+	tomlConfig := `
+[[tunnels]]
+id = "toml-tunnel"
+tunnel_host = "tunnel.beta.devetek.app"
+tunnel_port = 2220
+listener_host = "0.0.0.0"
+listener_port = "3001"
+service_host = "localhost"
+service_port = 3000
+state = "active"
+`
+
+	for format, data := range map[configFormat]string{configFormatYAML: yamlConfig, configFormatTOML: tomlConfig} {
+		configs, err := decodeConfigs([]byte(data), format, secretPolicy{restricted: true})
+		if err != nil {
+			t.Fatalf("Unexpected %s error: %v", format, err)
+		}
+		if len(configs) != 1 || configs[0].TunnelPort != "2220" || configs[0].ServicePort != "3000" {
+			t.Fatalf("Unexpected %s configs: %+v", format, configs)
+		}
+	}
+}
+
+func TestDecodeConfigs_UnknownField(t *testing.T) {
+	data := `[{"id": "typo", "tunnel_host": "127.0.0.1", "tunnel_port": "2220", "listener_host": "localhost", "listner_port": "3001", "service_host": "localhost", "service_port": "3000", "state": "active"}]`
+
+	_, err := decodeConfigs([]byte(data), configFormatJSON, secretPolicy{restricted: true})
+	if err == nil {
+		t.Fatalf("Expected error for unknown field")
+	}
+	if !strings.Contains(err.Error(), `tunnel[0] (id "typo")`) || !strings.Contains(err.Error(), "listner_port") {
+		t.Fatalf("Expected error to name tunnel and field, got %v", err)
+	}
+}
+
+func TestDecodeConfigs_Validation(t *testing.T) {
+	data := `[
+  {"id": "ok", "tunnel_host": "127.0.0.1", "tunnel_port": "2220", "listener_host": "localhost", "listener_port": "3001", "service_host": "localhost", "service_port": "3000", "state": "active"},
+  {"id": "bad", "tunnel_host": "127.0.0.1", "tunnel_port": "70000", "listener_host": "localhost", "listener_port": "3001", "service_port": "3000", "state": "active"}
+]`
+
+	_, err := decodeConfigs([]byte(data), configFormatJSON, secretPolicy{restricted: true})
+	if err == nil {
+		t.Fatalf("Expected validation error")
+	}
+
+	for _, expected := range []string{`tunnel[1] (id "bad"): tunnel_port`, `tunnel[1] (id "bad"): service_host: is required`} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("Expected error to contain %q, got %v", expected, err)
+		}
+	}
+}
+
+func TestDecodeConfigs_MissingStateIsInactive(t *testing.T) {
+	data := `[{"id": "legacy", "tunnel_host": "127.0.0.1", "tunnel_port": "2220", "listener_host": "localhost", "listener_port": "3001", "service_host": "localhost", "service_port": "3000"}]`
+
+	configs, err := decodeConfigs([]byte(data), configFormatJSON, secretPolicy{restricted: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if configs[0].State != ConfigStateInactive {
+		t.Fatalf("Expected tunnel without state to be inactive, got %q", configs[0].State)
+	}
+}
+
+func TestDecodeDocument_Defaults(t *testing.T) {
+	data := `
+version: 1
+manager:
+  interval: 5s
+  log:
+    level: debug
+defaults:
+  tunnel_host: tunnel.beta.devetek.app
+  tunnel_port: 2220
+  listener_host: 0.0.0.0
+  service_host: localhost
+  state: active
+  auth:
+    agent: true
+    agent_identity: deploy
+tunnels:
+  - id: web
+    listener_port: 3001
+    service_port: 3000
+  - id: api
+    tunnel_port: 2221
+    listener_port: 4001
+    service_port: 4000
+    auth:
+      agent_identity: api
+`
+
+	document, err := decodeDocument([]byte(data), configFormatYAML, secretPolicy{restricted: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if document.Version != 1 || time.Duration(document.Manager.Interval) != 5*time.Second || document.Manager.Log.Level != "debug" {
+		t.Fatalf("Unexpected manager settings: %+v", document.Manager)
+	}
+	if len(document.Tunnels) != 2 {
+		t.Fatalf("Expected 2 tunnels, got %d", len(document.Tunnels))
+	}
+
+	web, api := document.Tunnels[0], document.Tunnels[1]
+	if web.TunnelHost != "tunnel.beta.devetek.app" || web.TunnelPort != "2220" || web.Auth.AgentIdentity != "deploy" {
+		t.Fatalf("Expected web to inherit defaults, got %+v", web)
+	}
+	if api.TunnelPort != "2221" || !api.Auth.Agent || api.Auth.AgentIdentity != "api" {
+		t.Fatalf("Expected api to override single fields, got %+v", api)
+	}
+}
+
+func TestDecodeDocument_Invalid(t *testing.T) {
+	for name, data := range map[string]string{
+		`unknown field "tunnel"`:      `{"tunnel": []}`,
+		"unsupported version":         `{"version": 2, "tunnels": []}`,
+		"defaults: unknown field":     `{"defaults": {"tunel_host": "x"}, "tunnels": []}`,
+		"manager: log.level: unknown": `{"manager": {"log": {"level": "verbose"}}, "tunnels": []}`,
+	} {
+		_, err := decodeDocument([]byte(data), configFormatJSON, secretPolicy{restricted: true})
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Fatalf("Expected error containing %q, got %v", name, err)
+		}
+	}
+}
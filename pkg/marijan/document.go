@@ -0,0 +1,308 @@
+package marijan
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// latest supported config document version
+const documentVersion = 1
+
+// Document is a config document, either a bare list of tunnels or an object with
+// manager settings, defaults inherited by every tunnel and the tunnels list
+type Document struct {
+	Version int `json:"version,omitempty"`
+	// increasing revision of remote config, older revisions are rejected
+	Revision uint64          `json:"revision,omitempty"`
+	Manager  ManagerSettings `json:"manager,omitempty"`
+	Defaults Config          `json:"-"`
+	Tunnels  []Config        `json:"tunnels"`
+}
+
+// ManagerSettings holds manager settings written in config document
+type ManagerSettings struct {
+	Interval     Duration        `json:"interval,omitempty"`
+	DrainTimeout Duration        `json:"drain_timeout,omitempty"`
+	Declarative  bool            `json:"declarative,omitempty"`
+	Log          LogSettings     `json:"log,omitempty"`
+	Metrics      MetricsSettings `json:"metrics,omitempty"`
+	Admin        AdminSettings   `json:"admin,omitempty"`
+}
+
+// LogSettings holds logger settings written in config document
+type LogSettings struct {
+	// debug, info, warn or error, debug also enables verbose output
+	Level string `json:"level,omitempty"`
+	// json or console
+	Format string `json:"format,omitempty"`
+}
+
+// MetricsSettings holds prometheus metrics settings written in config document
+type MetricsSettings struct {
+	// address serving /metrics, disabled when empty
+	Address string `json:"address,omitempty"`
+}
+
+// AdminSettings holds admin API settings written in config document
+type AdminSettings struct {
+	// loopback address or unix socket path serving admin API, disabled when empty
+	Address string `json:"address,omitempty"`
+	// bearer token required by admin API, required for TCP address
+	Token string `json:"token,omitempty"`
+}
+
+// Validate checks manager settings and returns every problem found
+func (settings ManagerSettings) Validate() error {
+	var errs []error
+
+	if settings.Interval < 0 {
+		errs = append(errs, errors.New("interval: must not be negative"))
+	}
+	if settings.DrainTimeout < 0 {
+		errs = append(errs, errors.New("drain_timeout: must not be negative"))
+	}
+
+	switch settings.Log.Level {
+	case "", "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("log.level: unknown level %q, must be one of debug, info, warn or error", settings.Log.Level))
+	}
+
+	if settings.Metrics.Address != "" {
+		if _, _, err := net.SplitHostPort(settings.Metrics.Address); err != nil {
+			errs = append(errs, fmt.Errorf("metrics.address: %v", err))
+		}
+	}
+
+	if settings.Admin.Address != "" && !isUnixSocket(settings.Admin.Address) {
+		if _, _, err := net.SplitHostPort(settings.Admin.Address); err != nil {
+			errs = append(errs, fmt.Errorf("admin.address: %v", err))
+		} else if settings.Admin.Token == "" {
+			errs = append(errs, errors.New("admin.token: required when admin.address is a TCP address"))
+		}
+	}
+
+	switch settings.Log.Format {
+	case "", "json", "console":
+	default:
+		errs = append(errs, fmt.Errorf("log.format: unknown format %q, must be json or console", settings.Log.Format))
+	}
+
+	return errors.Join(errs...)
+}
+
+// keys allowed at the top level of config document object
+var documentKeys = map[string]bool{"version": true, "revision": true, "manager": true, "defaults": true, "tunnels": true}
+
+// decode value into target strictly, unknown fields are rejected
+func decodeStrict(value interface{}, target interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(target); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return fmt.Errorf("%s: must be %s", typeErr.Field, typeErr.Type)
+		}
+		return errors.New(strings.TrimPrefix(err.Error(), "json: "))
+	}
+
+	return nil
+}
+
+// merge override on top of base, nested objects are merged per field
+func mergeValues(base map[string]interface{}, override map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(override))
+
+	for key, value := range base {
+		if nested, ok := value.(map[string]interface{}); ok {
+			value = mergeValues(nested, nil)
+		}
+		merged[key] = value
+	}
+
+	for key, value := range override {
+		baseNested, baseOk := merged[key].(map[string]interface{})
+		overrideNested, overrideOk := value.(map[string]interface{})
+		if baseOk && overrideOk {
+			merged[key] = mergeValues(baseNested, overrideNested)
+			continue
+		}
+		merged[key] = value
+	}
+
+	return merged
+}
+
+// how config document is decoded
+type documentMode struct {
+	// tunnels may only set the fields they override
+	partial bool
+	// resolve ${...} placeholders
+	interpolate bool
+	// what placeholders may read, remote config may only read allowed variables and secret directories
+	secrets secretPolicy
+}
+
+// decode config document of remote source, a bare list of tunnels is still supported.
+// Placeholders may only read environment variables and files allowed by policy.
+func decodeDocument(data []byte, format configFormat, policy secretPolicy) (Document, error) {
+	return parseConfigDocument(data, format, documentMode{interpolate: true, secrets: policy})
+}
+
+// decode config document of local file, placeholders are resolved
+func decodeFileDocument(data []byte, format configFormat) (Document, error) {
+	return parseConfigDocument(data, format, documentMode{interpolate: true})
+}
+
+// decode override document of local file, tunnels may only set the fields they override and
+// are validated after being merged with lower layers
+func decodeOverrides(data []byte, format configFormat) (Document, error) {
+	return parseConfigDocument(data, format, documentMode{partial: true, interpolate: true})
+}
+
+func parseConfigDocument(data []byte, format configFormat, mode documentMode) (Document, error) {
+	var document Document
+
+	parsed, err := parseDocument(data, format)
+	if err != nil {
+		return document, err
+	}
+
+	// paths of values resolved from environment or files
+	secrets := map[string]bool{}
+	if mode.interpolate {
+		if parsed, err = interpolate(parsed, "", secrets, mode.secrets); err != nil {
+			return document, err
+		}
+	}
+	entryPrefix := "[%d]"
+
+	var defaults map[string]interface{}
+
+	if table, ok := parsed.(map[string]interface{}); ok {
+		entryPrefix = "tunnels[%d]"
+		for key := range table {
+			if !documentKeys[key] {
+				return document, fmt.Errorf("unknown field %q", key)
+			}
+		}
+
+		if version, found := table["version"]; found {
+			if err := decodeStrict(version, &document.Version); err != nil {
+				return document, fmt.Errorf("version: %v", err)
+			}
+			if document.Version < 1 || document.Version > documentVersion {
+				return document, fmt.Errorf("version: unsupported version %d, latest supported version is %d", document.Version, documentVersion)
+			}
+		}
+
+		if revision, found := table["revision"]; found {
+			if err := decodeStrict(revision, &document.Revision); err != nil {
+				return document, fmt.Errorf("revision: %v", err)
+			}
+		}
+
+		if settings, found := table["manager"]; found {
+			if err := decodeStrict(settings, &document.Manager); err != nil {
+				return document, fmt.Errorf("manager: %v", err)
+			}
+			if err := document.Manager.Validate(); err != nil {
+				return document, fmt.Errorf("manager: %v", err)
+			}
+		}
+
+		if value, found := table["defaults"]; found {
+			if defaults, ok = value.(map[string]interface{}); !ok {
+				return document, errors.New("defaults: must be an object")
+			}
+			normalizePorts(defaults)
+			if err := decodeStrict(defaults, &document.Defaults); err != nil {
+				return document, fmt.Errorf("defaults: %v", err)
+			}
+		}
+	}
+
+	entries, err := tunnelEntries(parsed)
+	if err != nil {
+		return document, err
+	}
+
+	document.Tunnels = make([]Config, 0, len(entries))
+	for index, entry := range entries {
+		merged := mergeValues(defaults, entry)
+		config, err := decodeConfig(merged)
+		if err != nil {
+			return document, fmt.Errorf("%s: %v", entryName(index, entry), err)
+		}
+		config.fields = fieldPaths(merged, "")
+		config.secrets = entrySecrets(secrets, fmt.Sprintf(entryPrefix, index), entry)
+		document.Tunnels = append(document.Tunnels, config)
+	}
+
+	if mode.partial {
+		return document, validateIDs(document.Tunnels)
+	}
+
+	defaultStates(document.Tunnels)
+	if err := validateConfigs(document.Tunnels); err != nil {
+		return document, err
+	}
+
+	return document, nil
+}
+
+// merge settings on top of current settings, only fields that are set override
+func (settings ManagerSettings) merge(other ManagerSettings) ManagerSettings {
+	if other.Interval != 0 {
+		settings.Interval = other.Interval
+	}
+	if other.DrainTimeout != 0 {
+		settings.DrainTimeout = other.DrainTimeout
+	}
+	if other.Declarative {
+		settings.Declarative = true
+	}
+	if other.Log.Level != "" {
+		settings.Log.Level = other.Log.Level
+	}
+	if other.Log.Format != "" {
+		settings.Log.Format = other.Log.Format
+	}
+	if other.Metrics.Address != "" {
+		settings.Metrics.Address = other.Metrics.Address
+	}
+	if other.Admin.Address != "" {
+		settings.Admin.Address = other.Admin.Address
+	}
+	if other.Admin.Token != "" {
+		settings.Admin.Token = other.Admin.Token
+	}
+
+	return settings
+}
+
+// ReadSettings reads manager settings from config path, a bare list of tunnels has no settings.
+// When path is a directory or glob pattern, settings of later files override earlier ones.
+func ReadSettings(path string) (ManagerSettings, error) {
+	var settings ManagerSettings
+
+	documents, err := readDocuments(path, false)
+	if err != nil {
+		return settings, err
+	}
+
+	for _, file := range documents {
+		settings = settings.merge(file.document.Manager)
+	}
+
+	return settings, nil
+}
@@ -0,0 +1,82 @@
+package marijan
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/devetek/tuman/pkg/tukiran"
+	"golang.org/x/crypto/ssh"
+)
+
+type HostKeyPolicy string
+
+const (
+	HostKeyPolicyInsecure    HostKeyPolicy = "insecure"
+	HostKeyPolicyKnownHosts  HostKeyPolicy = "known_hosts"
+	HostKeyPolicyFingerprint HostKeyPolicy = "fingerprint"
+	HostKeyPolicyTOFU        HostKeyPolicy = "tofu"
+)
+
+// HostKeyConfig holds how the tunnel server host key is verified
+type HostKeyConfig struct {
+	Policy         HostKeyPolicy `json:"policy,omitempty"`
+	KnownHostsFile string        `json:"known_hosts_file,omitempty"`
+	Fingerprints   []string      `json:"fingerprints,omitempty"`
+}
+
+// get default known_hosts file owned by marijan, used by trust-on-first-use policy
+func defaultKnownHostsFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".marijan/known_hosts"
+	}
+
+	return path.Join(home, ".marijan/known_hosts")
+}
+
+// get known_hosts file of known_hosts and trust-on-first-use policies
+func (manager *Manager) knownHostsFor(hostKey HostKeyConfig) string {
+	file := hostKey.KnownHostsFile
+	if file != "" {
+		return expandHome(file)
+	}
+
+	if hostKey.Policy == HostKeyPolicyTOFU {
+		return expandHome(manager.knownHostsFile)
+	}
+
+	return expandHome("~/.ssh/known_hosts")
+}
+
+// get host key callback based on configured policy
+func (manager *Manager) hostKeyCallback(hostKey HostKeyConfig) (ssh.HostKeyCallback, error) {
+	switch hostKey.Policy {
+	case "", HostKeyPolicyInsecure:
+		return ssh.InsecureIgnoreHostKey(), nil
+	case HostKeyPolicyKnownHosts:
+		return tukiran.KnownHostsCallback(manager.knownHostsFor(hostKey))
+	case HostKeyPolicyFingerprint:
+		if len(hostKey.Fingerprints) == 0 {
+			return nil, fmt.Errorf("host key policy %s requires at least one fingerprint", hostKey.Policy)
+		}
+		return tukiran.FingerprintCallback(hostKey.Fingerprints...), nil
+	case HostKeyPolicyTOFU:
+		return tukiran.TOFUCallback(manager.knownHostsFor(hostKey)), nil
+	}
+
+	return nil, fmt.Errorf("Unknown host key policy: %s", hostKey.Policy)
+}
+
+// get host key algorithms the server is asked for, known_hosts policies only accept key types
+// they know. Nil keeps the default algorithms.
+func (manager *Manager) hostKeyAlgorithms(hostKey HostKeyConfig, address string) ([]string, error) {
+	switch hostKey.Policy {
+	case HostKeyPolicyKnownHosts:
+		return tukiran.KnownHostsAlgorithms(address, manager.knownHostsFor(hostKey))
+	case HostKeyPolicyTOFU:
+		return tukiran.TOFUAlgorithms(address, manager.knownHostsFor(hostKey))
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,281 @@
+package marijan
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// placeholder shown instead of secret values
+const secretMask = "******"
+
+var variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// environment variables and files placeholders may read
+type secretPolicy struct {
+	// only variables of env and files inside dirs may be read, used for remote config
+	restricted bool
+	dirs       []string
+	env        []string
+}
+
+// check if environment variable may be read
+func (policy secretPolicy) allowEnv(name string) error {
+	if !policy.restricted || slices.Contains(policy.env, name) {
+		return nil
+	}
+
+	return fmt.Errorf("${%s} is not an environment variable allowed for remote config", name)
+}
+
+// check if file may be read, symlinks are resolved so they can not point outside of dirs
+func (policy secretPolicy) allowFile(file string) error {
+	if !policy.restricted {
+		return nil
+	}
+
+	resolved, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return fmt.Errorf("Error reading secret file: %v", err)
+	}
+	if resolved, err = filepath.Abs(resolved); err != nil {
+		return fmt.Errorf("Error reading secret file: %v", err)
+	}
+
+	for _, dir := range policy.dirs {
+		dir, err := filepath.EvalSymlinks(expandHome(dir))
+		if err != nil {
+			continue
+		}
+		if dir, err = filepath.Abs(dir); err != nil {
+			continue
+		}
+
+		relative, err := filepath.Rel(dir, resolved)
+		if err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("${file:%s} is outside of secret directories allowed for remote config", file)
+}
+
+// replace ${...} in every string value of parsed config document.
+// Supported forms are ${VAR}, ${VAR:-default}, ${VAR:?message} and ${file:/path},
+// $${ is written as a literal ${. Errors never contain resolved values, paths of values
+// resolved from environment or files are added to secrets.
+func interpolate(value interface{}, path string, secrets map[string]bool, policy secretPolicy) (interface{}, error) {
+	switch typed := value.(type) {
+	case string:
+		expanded, secret, err := expand(typed, policy)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if secret {
+			secrets[path] = true
+		}
+		return expanded, nil
+	case map[string]interface{}:
+		for key, item := range typed {
+			itemPath := key
+			if path != "" {
+				itemPath = path + "." + key
+			}
+
+			expanded, err := interpolate(item, itemPath, secrets, policy)
+			if err != nil {
+				return nil, err
+			}
+			typed[key] = expanded
+		}
+		return typed, nil
+	case []interface{}:
+		for index, item := range typed {
+			expanded, err := interpolate(item, fmt.Sprintf("%s[%d]", path, index), secrets, policy)
+			if err != nil {
+				return nil, err
+			}
+			typed[index] = expanded
+		}
+		return typed, nil
+	}
+
+	return value, nil
+}
+
+// expand placeholders of a single string value, secret reports if a value was resolved
+// from environment or a file
+func expand(value string, policy secretPolicy) (string, bool, error) {
+	if !strings.Contains(value, "${") {
+		return value, false, nil
+	}
+
+	var result strings.Builder
+	secret := false
+
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			result.WriteString(value)
+			return result.String(), secret, nil
+		}
+
+		// escaped placeholder
+		if start > 0 && value[start-1] == '$' {
+			result.WriteString(value[:start-1])
+			result.WriteString("${")
+			value = value[start+2:]
+			continue
+		}
+
+		end := strings.Index(value[start:], "}")
+		if end < 0 {
+			return "", false, errors.New("unterminated ${ placeholder")
+		}
+
+		resolved, fromSecret, err := resolve(value[start+2:start+end], policy)
+		if err != nil {
+			return "", false, err
+		}
+		secret = secret || fromSecret
+
+		result.WriteString(value[:start])
+		result.WriteString(resolved)
+		value = value[start+end+1:]
+	}
+}
+
+// resolve placeholder expression to its value, secret is false when default value is used
+func resolve(expression string, policy secretPolicy) (string, bool, error) {
+	if file, ok := strings.CutPrefix(expression, "file:"); ok {
+		if file == "" {
+			return "", false, errors.New("${file:} requires a path")
+		}
+
+		file = expandHome(file)
+		if err := policy.allowFile(file); err != nil {
+			return "", false, err
+		}
+
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", false, fmt.Errorf("Error reading secret file: %v", err)
+		}
+
+		// secret files usually end with a newline
+		return strings.TrimRight(string(content), "\r\n"), true, nil
+	}
+
+	name, fallback, hasDefault := strings.Cut(expression, ":-")
+	message := ""
+	required := false
+	if !hasDefault {
+		name, message, required = strings.Cut(expression, ":?")
+	}
+
+	if !variableName.MatchString(name) {
+		return "", false, fmt.Errorf("invalid variable name %q", name)
+	}
+	if err := policy.allowEnv(name); err != nil {
+		return "", false, err
+	}
+
+	value := os.Getenv(name)
+	switch {
+	case value != "":
+		return value, true, nil
+	case hasDefault:
+		return fallback, false, nil
+	case required:
+		if message == "" {
+			message = "required variable is not set"
+		}
+		return "", false, fmt.Errorf("${%s}: %s", name, message)
+	}
+
+	return value, false, nil
+}
+
+// get secret field paths of tunnel entry at prefix, secrets of defaults are inherited unless
+// entry sets the same field
+func entrySecrets(secrets map[string]bool, prefix string, entry map[string]interface{}) []string {
+	var paths []string
+
+	for path := range secrets {
+		if field, ok := strings.CutPrefix(path, prefix+"."); ok {
+			paths = append(paths, field)
+			continue
+		}
+		if field, ok := strings.CutPrefix(path, "defaults."); ok {
+			if _, set := valueAt(entry, field); !set {
+				paths = append(paths, field)
+			}
+		}
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+// check if field path holds a value resolved from environment or a file
+func (config Config) isSecret(path string) bool {
+	for _, secret := range config.secrets {
+		if secret == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Masked returns a copy of config with secret values replaced by a placeholder, both
+// credentials and every value resolved from environment or files
+func (config Config) Masked() Config {
+	for _, secret := range []*string{&config.Auth.PrivateKey, &config.Auth.Passphrase, &config.Auth.Password} {
+		if *secret != "" {
+			*secret = secretMask
+		}
+	}
+
+	for _, path := range config.secrets {
+		maskField(reflect.ValueOf(&config).Elem(), path)
+	}
+
+	return config
+}
+
+// replace string value at field path of struct, list items like `fingerprints[0]` mask the
+// whole list. Other types are kept, they can not hold a secret.
+func maskField(value reflect.Value, path string) {
+	key, rest, nested := strings.Cut(path, ".")
+	key, _, _ = strings.Cut(key, "[")
+
+	for index := 0; index < value.NumField(); index++ {
+		name, _, _ := strings.Cut(value.Type().Field(index).Tag.Get("json"), ",")
+		if name != key {
+			continue
+		}
+
+		field := value.Field(index)
+		switch {
+		case nested && field.Kind() == reflect.Struct:
+			maskField(field, rest)
+		case field.Kind() == reflect.String && field.Len() > 0:
+			field.SetString(secretMask)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+			// copy keeps the list of the original config
+			masked := reflect.MakeSlice(field.Type(), field.Len(), field.Len())
+			for item := 0; item < field.Len(); item++ {
+				masked.Index(item).SetString(secretMask)
+			}
+			field.Set(masked)
+		}
+		return
+	}
+}
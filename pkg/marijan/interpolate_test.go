@@ -0,0 +1,146 @@
+package marijan
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecodeDocument_Interpolation(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(secret, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("Failed to write secret file: %v", err)
+	}
+
+	t.Setenv("MARIJAN_TEST_HOST", "tunnel.beta.devetek.app")
+	t.Setenv("MARIJAN_TEST_PASSPHRASE", "from-env")
+
+	data := `
+defaults:
+  tunnel_host: ${MARIJAN_TEST_HOST}
+  tunnel_port: ${MARIJAN_TEST_PORT:-2220}
+  listener_host: 0.0.0.0
+  service_host: localhost
+  state: active
+tunnels:
+  - id: web
+    listener_port: 3001
+    service_port: 3000
+    auth:
+      password: ${file:` + secret + `}
+      passphrase: ${MARIJAN_TEST_PASSPHRASE}
+      agent_identity: $${literal}
+`
+
+	document, err := decodeFileDocument([]byte(data), configFormatYAML)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	config := document.Tunnels[0]
+	if config.TunnelHost != "tunnel.beta.devetek.app" || config.TunnelPort != "2220" {
+		t.Fatalf("Expected env and default to be resolved, got %+v", config)
+	}
+	if config.Auth.Password != "from-file" || config.Auth.Passphrase != "from-env" || config.Auth.AgentIdentity != "${literal}" {
+		t.Fatalf("Unexpected auth: %+v", config.Auth)
+	}
+
+	masked := config.Masked()
+	if masked.Auth.Password != secretMask || masked.Auth.Passphrase != secretMask || config.Auth.Password != "from-file" {
+		t.Fatalf("Expected masked copy, got %+v", masked.Auth)
+	}
+
+	// values resolved into other fields are masked too, defaults fall back to the written value
+	if masked.TunnelHost != secretMask || masked.TunnelPort != "2220" || masked.Auth.AgentIdentity != "${literal}" || config.TunnelHost != "tunnel.beta.devetek.app" {
+		t.Fatalf("Expected resolved tunnel host to be masked, got %+v", masked)
+	}
+}
+
+func TestGetConfigFromRemote_Interpolation(t *testing.T) {
+	secrets := t.TempDir()
+	if err := os.WriteFile(filepath.Join(secrets, "key-pass"), []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("Failed to write secret file: %v", err)
+	}
+	outside := filepath.Join(t.TempDir(), "other")
+	if err := os.WriteFile(outside, []byte("leaked-secret"), 0600); err != nil {
+		t.Fatalf("Failed to write secret file: %v", err)
+	}
+
+	t.Setenv("MARIJAN_TEST_PASSWORD", "from-env")
+
+	body := `[{"id": "web", "tunnel_host": "tunnel.example.com", "tunnel_port": "22", "tunnel_user": "${MARIJAN_TEST_USER:-deploy}",
+		"listener_host": "0.0.0.0", "listener_port": "3001", "service_host": "localhost", "service_port": "3000", "state": "active",
+		"auth": {"password": "${MARIJAN_TEST_PASSWORD}", "passphrase": "${file:` + filepath.Join(secrets, "key-pass") + `}"}}]`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	provider := NewRemoteProvider(server.URL, RemoteOptions{
+		SecretEnv:  []string{"MARIJAN_TEST_USER", "MARIJAN_TEST_PASSWORD"},
+		SecretDirs: []string{secrets},
+	})
+	configs, err := provider.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	config := configs[0]
+	if config.TunnelUser != "deploy" || config.Auth.Password != "from-env" || config.Auth.Passphrase != "from-file" {
+		t.Fatalf("Expected remote placeholders to be resolved, got %+v", config)
+	}
+
+	masked := config.Masked()
+	if masked.Auth.Password != secretMask || masked.Auth.Passphrase != secretMask || masked.TunnelUser != "deploy" {
+		t.Fatalf("Expected resolved values to be masked, got %+v", masked)
+	}
+
+	// files outside of secret directories are rejected without leaking their content
+	body = strings.Replace(body, filepath.Join(secrets, "key-pass"), outside, 1)
+	_, err = provider.Fetch(withForceFetch(context.Background()))
+	if err == nil || !strings.Contains(err.Error(), "outside of secret directories") || strings.Contains(err.Error(), "leaked-secret") {
+		t.Fatalf("Expected file outside of secret directories to be rejected, got %v", err)
+	}
+
+	// variables that are not allowed, such as the remote token, can not be sent to the server
+	t.Setenv("MARIJAN_REMOTE_TOKEN", "leaked-token")
+	body = strings.Replace(body, "${MARIJAN_TEST_USER:-deploy}", "${MARIJAN_REMOTE_TOKEN}", 1)
+	body = strings.Replace(body, outside, filepath.Join(secrets, "key-pass"), 1)
+	_, err = provider.Fetch(withForceFetch(context.Background()))
+	if err == nil || !strings.Contains(err.Error(), "not an environment variable allowed") || strings.Contains(err.Error(), "leaked-token") {
+		t.Fatalf("Expected variable that is not allowed to be rejected, got %v", err)
+	}
+}
+
+func TestDecodeDocument_SecretNotInErrors(t *testing.T) {
+	t.Setenv("MARIJAN_TEST_PORT", "not-a-port-but-secret")
+
+	data := `[{"id": "web", "tunnel_host": "tunnel.example.com", "tunnel_port": "${MARIJAN_TEST_PORT}",
+		"listener_host": "0.0.0.0", "listener_port": "3001", "service_host": "localhost", "service_port": "3000", "state": "active"}]`
+
+	_, err := decodeFileDocument([]byte(data), configFormatJSON)
+	if err == nil || !strings.Contains(err.Error(), "tunnel_port") || strings.Contains(err.Error(), "not-a-port-but-secret") {
+		t.Fatalf("Expected port error without resolved value, got %v", err)
+	}
+}
+
+func TestDecodeDocument_InterpolationErrors(t *testing.T) {
+	for expected, value := range map[string]string{
+		"${MARIJAN_TEST_MISSING}: set the password": "${MARIJAN_TEST_MISSING:?set the password}",
+		"required variable is not set":              "${MARIJAN_TEST_MISSING:?}",
+		"Error reading secret file":                 "${file:/does/not/exist}",
+		"unterminated":                              "${MARIJAN_TEST_MISSING",
+	} {
+		data := `[{"id": "web", "auth": {"password": "` + value + `"}}]`
+
+		_, err := decodeFileDocument([]byte(data), configFormatJSON)
+		if err == nil || !strings.Contains(err.Error(), expected) || !strings.Contains(err.Error(), "[0].auth.password") {
+			t.Fatalf("Expected error containing %q, got %v", expected, err)
+		}
+	}
+}
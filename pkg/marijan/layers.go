@@ -0,0 +1,163 @@
+package marijan
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// layer of tunnels changed through runtime API, it takes precedence over every provider
+const runtimeLayer = "runtime"
+
+// get field paths set in raw config entry, nested objects are flattened like `auth.password`
+func fieldPaths(entry map[string]interface{}, prefix string) []string {
+	var paths []string
+
+	for key, value := range entry {
+		path := prefix + key
+		if nested, ok := value.(map[string]interface{}); ok && len(nested) > 0 {
+			paths = append(paths, fieldPaths(nested, path+".")...)
+			continue
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+// get config as generic values keyed like config documents
+func configValues(config Config) map[string]interface{} {
+	var values map[string]interface{}
+
+	// Config always marshals, it only holds strings, numbers and durations
+	data, _ := json.Marshal(config)
+	json.Unmarshal(data, &values)
+
+	return values
+}
+
+// check if generic value is empty
+func isZeroValue(value interface{}) bool {
+	switch typed := value.(type) {
+	case nil:
+		return true
+	case string:
+		return typed == "" || typed == "0s"
+	case bool:
+		return !typed
+	case float64:
+		return typed == 0
+	case []interface{}:
+		return len(typed) == 0
+	case map[string]interface{}:
+		return len(typed) == 0
+	}
+
+	return false
+}
+
+// get field paths of config that are not empty, used for configs without field information
+func nonZeroPaths(config Config) []string {
+	var paths []string
+
+	var walk func(values map[string]interface{}, prefix string)
+	walk = func(values map[string]interface{}, prefix string) {
+		for key, value := range values {
+			if nested, ok := value.(map[string]interface{}); ok {
+				walk(nested, prefix+key+".")
+				continue
+			}
+			if !isZeroValue(value) {
+				paths = append(paths, prefix+key)
+			}
+		}
+	}
+	walk(configValues(config), "")
+	sort.Strings(paths)
+
+	return paths
+}
+
+// get value at field path
+func valueAt(values map[string]interface{}, path string) (interface{}, bool) {
+	key, rest, nested := strings.Cut(path, ".")
+	value, ok := values[key]
+	if !ok || !nested {
+		return value, ok
+	}
+
+	child, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	return valueAt(child, rest)
+}
+
+// set value at field path, missing objects are created
+func setValueAt(values map[string]interface{}, path string, value interface{}) {
+	key, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		values[key] = value
+		return
+	}
+
+	child, ok := values[key].(map[string]interface{})
+	if !ok {
+		child = map[string]interface{}{}
+		values[key] = child
+	}
+
+	setValueAt(child, rest, value)
+}
+
+// overlay fields set in override on top of base, every other field keeps base value
+func overlay(base Config, override Config) (Config, error) {
+	values := configValues(base)
+	overrideValues := configValues(override)
+
+	// empty values are omitted when marshalling, null resets them
+	for _, path := range override.fields {
+		value, _ := valueAt(overrideValues, path)
+		setValueAt(values, path, value)
+	}
+
+	var merged Config
+	if err := decodeStrict(values, &merged); err != nil {
+		return base, err
+	}
+
+	return merged, nil
+}
+
+// get secret fields of overlay result, secrets of base are kept for fields override does not set
+func overlaySecrets(base Config, override Config) []string {
+	set := make(map[string]bool, len(override.fields))
+	for _, path := range override.fields {
+		set[path] = true
+	}
+
+	secrets := append([]string{}, override.secrets...)
+	for _, path := range base.secrets {
+		if !set[path] {
+			secrets = append(secrets, path)
+		}
+	}
+	sort.Strings(secrets)
+
+	return secrets
+}
+
+// record layer of every field set by config
+func (config *Config) setOrigins(layer string, paths []string) {
+	origins := make(map[string]string, len(config.origins)+len(paths))
+	for path, origin := range config.origins {
+		origins[path] = origin
+	}
+	for _, path := range paths {
+		origins[path] = layer
+	}
+
+	config.origins = origins
+}
@@ -0,0 +1,83 @@
+package marijan
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLayers_RemoteWithOverride(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[` + tunnelJSON("web") + `, ` + tunnelJSON("api") + `]`))
+	}))
+	defer server.Close()
+
+	override := filepath.Join(t.TempDir(), "override.yaml")
+	data := `
+- id: web
+  service_port: 8080
+  auth:
+    agent: true
+- id: api
+  state: inactive
+- id: debug
+  tunnel_host: 127.0.0.1
+  tunnel_port: 1
+  listener_host: localhost
+  listener_port: 9001
+  service_host: localhost
+  service_port: 9000
+  state: active
+`
+	if err := os.WriteFile(override, []byte(data), 0600); err != nil {
+		t.Fatalf("Failed to write override: %v", err)
+	}
+
+	manager := NewManager(
+		WithSource(ConfigSourceRemote),
+		WithURL(server.URL),
+		WithProvider(NewOverrideProvider(override, false)),
+	)
+	if err := manager.setupProviders(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	configs, err := manager.fetchAll(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	manager.apply(configs)
+
+	web, ok := manager.GetTunnel("web")
+	if !ok || web.ServicePort != "8080" || web.ListenerPort != "3001" || !web.Auth.Agent {
+		t.Fatalf("Expected web fields merged, got %+v", web)
+	}
+	if _, ok := manager.GetTunnel("api"); ok {
+		t.Fatalf("Expected api to be forced inactive")
+	}
+	if _, ok := manager.GetTunnel("debug"); !ok {
+		t.Fatalf("Expected debug tunnel from override")
+	}
+
+	for _, status := range manager.Status() {
+		if status.ID != "web" {
+			continue
+		}
+		remote, local := "remote "+server.URL, "override "+override
+		if status.Fields["service_port"] != local || status.Fields["auth.agent"] != local || status.Fields["listener_port"] != remote {
+			t.Fatalf("Unexpected field layers: %v", status.Fields)
+		}
+	}
+
+	// override of a tunnel missing required fields is rejected after merging
+	if err := os.WriteFile(override, []byte("- {id: extra, service_port: 9000, state: active}"), 0600); err != nil {
+		t.Fatalf("Failed to write override: %v", err)
+	}
+	if _, err := manager.fetchAll(context.Background()); err == nil || !strings.Contains(err.Error(), `"extra"`) {
+		t.Fatalf("Expected validation error for partial tunnel, got %v", err)
+	}
+}
@@ -11,11 +11,11 @@ Copyright (c) 2025 Devetek. All rights reserved.
 */
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
-	"os"
+	"sync"
 	"time"
 
 	"github.com/devetek/tuman/pkg/tukiran"
@@ -32,13 +32,56 @@ const (
 )
 
 type Manager struct {
-	// ctx     context.Context
+	// lifetime of manager, set by Run or Start
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	// lifetime of connections, outlives ctx so connections can drain
+	connCtx      context.Context
+	connCancel   context.CancelFunc
+	drainTimeout time.Duration
 	debugEnabled bool
 	source       ConfigSource
 	url          string
 	interval     time.Duration
-	configs      []Config
-	// wg      sync.WaitGroup
+	// managed configs and their connections, guarded by mu
+	mu      sync.RWMutex
+	configs []Config
+	// last configs fetched from source and tunnels changed through runtime API
+	sourceConfigs []Config
+	overrides     map[string]Config
+	// tunnels paused through Pause, kept closed until resumed
+	paused map[string]bool
+	// config providers, source provider first and providers of WithProvider after it
+	providerList []ConfigProvider
+	providers    []*providerState
+	// reload config on file change instead of polling, reload is triggered by Reload
+	watch  bool
+	reload chan struct{}
+	// source is the full desired state, tunnels missing from it are removed
+	declarative bool
+	allowEmpty  bool
+	// remote config HTTP client settings of remote source
+	remote RemoteOptions
+	// known_hosts file written by trust-on-first-use policy
+	knownHostsFile string
+	// reconnect backoff, tunnel config can override each value
+	backoffInitial    time.Duration
+	backoffMax        time.Duration
+	backoffResetAfter time.Duration
+	// prometheus metrics, served on metrics address when set
+	metrics        *metrics
+	metricsAddress string
+	metricsServer  *http.Server
+	// admin API, served on admin address when set
+	adminAddress  string
+	adminToken    string
+	adminListener net.Listener
+	adminServer   *http.Server
+	// set once shutdown starts, no connection is started or changed while draining
+	stopping bool
+	// running connections, waited on shutdown
+	wg  sync.WaitGroup
 	zap *zap.Logger
 }
 
@@ -50,24 +93,49 @@ const (
 )
 
 type Config struct {
-	NoTCP        bool        `json:"no_tcp"`
-	ID           string      `json:"id"`
-	TunnelHost   string      `json:"tunnel_host"`
-	TunnelPort   string      `json:"tunnel_port"`
-	ListenerHost string      `json:"listener_host"`
-	ListenerPort string      `json:"listener_port"`
-	ServiceHost  string      `json:"service_host"`
-	ServicePort  string      `json:"service_port"`
-	State        ConfigState `json:"state,omitempty"`
-	connection   *tukiran.TunnelForwarder
+	NoTCP        bool          `json:"no_tcp"`
+	ID           string        `json:"id"`
+	TunnelHost   string        `json:"tunnel_host"`
+	TunnelPort   string        `json:"tunnel_port"`
+	TunnelUser   string        `json:"tunnel_user,omitempty"`
+	ListenerHost string        `json:"listener_host"`
+	ListenerPort string        `json:"listener_port"`
+	ServiceHost  string        `json:"service_host"`
+	ServicePort  string        `json:"service_port"`
+	State        ConfigState   `json:"state,omitempty"`
+	Auth         AuthConfig    `json:"auth,omitempty"`
+	HostKey      HostKeyConfig `json:"host_key,omitempty"`
+	// send keepalive to tunnel server every interval, disabled when empty
+	KeepaliveInterval  Duration `json:"keepalive_interval,omitempty"`
+	KeepaliveMaxMissed int      `json:"keepalive_max_missed,omitempty"`
+	// reconnect backoff, empty uses manager settings
+	ReconnectInitial    Duration `json:"reconnect_initial,omitempty"`
+	ReconnectMax        Duration `json:"reconnect_max,omitempty"`
+	ReconnectResetAfter Duration `json:"reconnect_reset_after,omitempty"`
+	connection          *tukiran.TunnelForwarder
+	reconnect           reconnectState
+	// fields set in config source and layer each effective field came from
+	fields  []string
+	origins map[string]string
+	// fields resolved from environment or files, masked like credentials
+	secrets []string
 }
 
 func NewManager(opts ...ManagerOpt) *Manager {
 	conf := &Manager{
-		debugEnabled: false,
-		interval:     time.Minute,
-		configs:      []Config{},
+		debugEnabled:      false,
+		interval:          time.Minute,
+		configs:           []Config{},
+		overrides:         map[string]Config{},
+		paused:            map[string]bool{},
+		reload:            make(chan struct{}, 1),
+		knownHostsFile:    defaultKnownHostsFile(),
+		backoffInitial:    time.Second,
+		backoffMax:        defaultBackoffMax,
+		backoffResetAfter: time.Minute,
+		drainTimeout:      30 * time.Second,
 	}
+	conf.metrics = newMetrics(conf)
 	for _, opt := range opts {
 		opt(conf)
 	}
@@ -88,146 +156,277 @@ func (manager *Manager) debug(message string) {
 	}
 }
 
-func (manager *Manager) createNewConnection(config Config) *tukiran.TunnelForwarder {
+func (manager *Manager) createNewConnection(config Config) (*tukiran.TunnelForwarder, error) {
+	agentAuth := config.Auth.agentAuth()
+	authMethods, err := config.Auth.authMethods(agentAuth)
+	if err != nil {
+		return nil, fmt.Errorf("Error preparing authentication for connection ID %s: %v", config.ID, err)
+	}
+
+	hostKeyCallback, err := manager.hostKeyCallback(config.HostKey)
+	if err != nil {
+		return nil, fmt.Errorf("Error preparing host key verification for connection ID %s: %v", config.ID, err)
+	}
+
+	hostKeyAlgorithms, err := manager.hostKeyAlgorithms(config.HostKey, net.JoinHostPort(config.TunnelHost, config.TunnelPort))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading known host keys for connection ID %s: %v", config.ID, err)
+	}
+
 	return tukiran.NewTunnelRemoteForwarder(
 		tukiran.WithLogger(manager.zap),
+		tukiran.WithObserver(manager.metrics),
 		tukiran.WithSocketListener(config.NoTCP),
 		tukiran.WithConnectionID(config.ID),
 		tukiran.WithTunnelHost(config.TunnelHost),
 		tukiran.WithTunnelPort(config.TunnelPort),
 		tukiran.WithTunnelAuthMethod(&ssh.ClientConfig{
-			Auth:            []ssh.AuthMethod{},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			User:              config.TunnelUser,
+			Auth:              authMethods,
+			HostKeyCallback:   hostKeyCallback,
+			HostKeyAlgorithms: hostKeyAlgorithms,
 		}),
+		tukiran.WithAgentAuth(agentAuth),
+		tukiran.WithKeepalive(time.Duration(config.KeepaliveInterval), config.KeepaliveMaxMissed),
 		tukiran.WithListenerHost(config.ListenerHost),
 		tukiran.WithListenerPort(config.ListenerPort),
 		tukiran.WithServiceHost(config.ServiceHost),
 		tukiran.WithServicePort(config.ServicePort),
-	)
+	), nil
 }
 
-func (manager *Manager) getNewConfig() ([]Config, error) {
-	if manager.source == ConfigSourceFile {
-		newConfigs, err := manager.getConfigFromFile()
-		if err != nil {
-			return nil, fmt.Errorf("Error fetching config from file: %v", err)
+// create a new connection for config at index and start it in background
+func (manager *Manager) connect(index int) error {
+	if manager.stopping {
+		return ErrStopping
+	}
+
+	config := manager.configs[index]
+
+	// every attempt counts, including the ones failing before dial
+	manager.configs[index].reconnect.attempt(time.Now())
+
+	connection, err := manager.createNewConnection(config)
+	if err != nil {
+		manager.configs[index].reconnect.failed(manager.backoffFor(config), time.Now())
+		return err
+	}
+
+	// previous connection may still hold the remote listener
+	if config.connection != nil {
+		config.connection.Close()
+		manager.metrics.reconnects.WithLabelValues(config.ID).Inc()
+	}
+	manager.configs[index].connection = connection
+
+	manager.wg.Add(1)
+	go func() {
+		defer manager.wg.Done()
+
+		// start new connection!
+		err := connection.ListenAndServe(manager.connCtx)
+		if err != nil && manager.ctx.Err() == nil {
+			manager.logger().Error("Error running connection", zap.String("id", config.ID), zap.Error(err))
 		}
-		return newConfigs, nil
-	} else if manager.source == ConfigSourceRemote {
-		newConfigs, err := manager.getConfigFromRemote()
-		if err != nil {
-			return nil, fmt.Errorf("Error fetching config from remote: %v", err)
+
+		// connections closing after tunnel was removed must not bring its series back
+		manager.mu.RLock()
+		removed := manager.indexOf(config.ID) < 0
+		manager.mu.RUnlock()
+		if removed {
+			manager.metrics.forget(config.ID)
 		}
-		return newConfigs, nil
-	}
+	}()
 
-	return nil, fmt.Errorf("Unknown config source: %s", manager.source)
+	return nil
 }
 
 // get current configs
 func (manager *Manager) GetCurrentConfigs() []Config {
-	return manager.configs
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	// secrets are masked, they may be shown in logs and status output
+	configs := make([]Config, 0, len(manager.configs))
+	for _, config := range manager.configs {
+		configs = append(configs, config.Masked())
+	}
+
+	return configs
 }
 
-func (manager *Manager) Start() {
-	newConfigs, err := manager.getNewConfig()
-	if err != nil {
-		manager.logger().Error("Error fetching config:", zap.Error(err))
-		os.Exit(1)
+// load initial config and start active connections
+func (manager *Manager) load(ctx context.Context) error {
+	manager.mu.Lock()
+	manager.ctx = ctx
+	manager.connCtx, manager.connCancel = context.WithCancel(context.WithoutCancel(ctx))
+	manager.mu.Unlock()
+
+	if err := manager.listenMetrics(); err != nil {
+		manager.connCancel()
+		return err
 	}
 
-	// compare new config with old config
-	for _, newConfig := range newConfigs {
-		found := false
-		for _, oldConfig := range manager.configs {
-			if newConfig.ID == oldConfig.ID {
-				found = true
-				break
-			}
-		}
-		if !found {
-			// append new connection if not found and state is active
-			if newConfig.State == ConfigStateActive {
-				manager.configs = append(manager.configs, newConfig)
-			}
-		}
+	if err := manager.listenAdmin(); err != nil {
+		manager.closeServers()
+		manager.connCancel()
+		return err
 	}
 
-	// attach connection to the config
-	for index, config := range manager.configs {
-		if config.State == ConfigStateActive {
-			manager.configs[index].connection = manager.createNewConnection(config)
-		}
+	if err := manager.setupProviders(); err != nil {
+		manager.closeServers()
+		manager.connCancel()
+		return err
 	}
 
-	for _, config := range manager.configs {
-		if config.State == ConfigStateActive {
-			go func() {
-				err := config.connection.ListenAndServe()
-				if err != nil {
-					log.Println(err)
-				}
-			}()
-		}
+	newConfigs, err := manager.fetchAll(ctx)
+	if err != nil {
+		manager.closeServers()
+		manager.connCancel()
+		return err
 	}
 
-	// running connection checker
-	go manager.tick()
+	manager.apply(newConfigs)
+	manager.serveAdmin()
+
+	return nil
 }
 
-func (manager *Manager) StopAll() {
-	for _, config := range manager.configs {
-		if config.connection != nil {
-			config.connection.Close()
-		}
+// maintain connections until context is cancelled, then drain and close them
+func (manager *Manager) run(ctx context.Context) {
+	watchDone := manager.startWatch(ctx)
+	manager.tick(ctx)
+
+	// drain only waits for connections started before it
+	manager.mu.Lock()
+	manager.stopping = true
+	manager.mu.Unlock()
+
+	<-watchDone
+	manager.drain()
+	manager.connCancel()
+	manager.wg.Wait()
+	manager.closeServers()
+}
+
+// stop serving metrics and admin API
+func (manager *Manager) closeServers() {
+	manager.closeAdmin()
+	manager.closeMetrics()
+}
+
+// Reload fetches config from every provider on next loop iteration without waiting for interval.
+// It is safe to call while starting, config is fetched on startup anyway.
+func (manager *Manager) Reload() {
+	manager.mu.RLock()
+	providers := manager.providers
+	manager.mu.RUnlock()
+
+	for _, state := range providers {
+		state.dirty.Store(true)
 	}
+	manager.signalReload()
 }
 
-func (manager *Manager) getConfigFromFile() ([]Config, error) {
-	var configs []Config
+// wake up loop to fetch dirty providers
+func (manager *Manager) signalReload() {
+	select {
+	case manager.reload <- struct{}{}:
+	default:
+		// reload already pending
+	}
+}
 
-	file, err := os.ReadFile(manager.url)
-	if err != nil {
-		return configs, fmt.Errorf("Error reading file: %v", err)
+// stop accepting on every tunnel and wait for in-flight connections up to drain timeout
+func (manager *Manager) drain() {
+	ctx, cancel := context.WithTimeout(context.Background(), manager.drainTimeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var drained, killed int
+
+	for _, config := range manager.GetCurrentConfigs() {
+		if config.connection == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			connDrained, connKilled := config.connection.Shutdown(ctx)
+
+			mu.Lock()
+			drained += connDrained
+			killed += connKilled
+			mu.Unlock()
+		}()
 	}
+	wg.Wait()
 
-	if err := json.Unmarshal(file, &configs); err != nil {
-		return configs, fmt.Errorf("Error unmarshalling JSON: %v", err)
+	manager.logger().Info("Tunnel connections drained",
+		zap.Int("drained", drained),
+		zap.Int("killed", killed),
+	)
+}
+
+// Run loads config and maintains tunnels until ctx is cancelled. It blocks until in-flight
+// connections are drained and every connection is closed, config errors are returned
+// instead of exiting the process.
+func (manager *Manager) Run(ctx context.Context) error {
+	if err := manager.load(ctx); err != nil {
+		return err
 	}
 
-	return configs, nil
+	manager.run(ctx)
+
+	return nil
 }
 
-func (manager *Manager) getConfigFromRemote() ([]Config, error) {
-	var configs []Config
+// Start loads config and maintains tunnels in background until StopAll is called
+func (manager *Manager) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
 
-	// Create a custom HTTP client with a timeout
-	client := &http.Client{
-		Timeout: 10 * time.Second, // Set a timeout for the request
+	if err := manager.load(ctx); err != nil {
+		cancel()
+		return err
 	}
 
-	// Make the GET request
-	resp, err := client.Get(manager.url)
-	if err != nil {
-		return configs, fmt.Errorf("Error making GET request: %v", err)
-	}
-	defer resp.Body.Close() // Ensure the response body is closed
+	manager.cancel = cancel
+	manager.done = make(chan struct{})
+
+	// running connection checker
+	go func() {
+		defer close(manager.done)
+		manager.run(ctx)
+	}()
+
+	return nil
+}
 
-	// Check the HTTP status code
-	if resp.StatusCode != http.StatusOK {
-		return configs, fmt.Errorf("Received non-OK HTTP status: %s", resp.Status)
+// close every connection
+func (manager *Manager) closeAll() {
+	for _, config := range manager.GetCurrentConfigs() {
+		if config.connection != nil {
+			config.connection.Close()
+		}
 	}
+}
 
-	// Decode the JSON response into a struct
-	if err := json.NewDecoder(resp.Body).Decode(&configs); err != nil {
-		return configs, fmt.Errorf("Error decoding JSON response: %v", err)
+// stop tunnels started by Start and wait until they are closed
+func (manager *Manager) StopAll() {
+	if manager.cancel == nil {
+		manager.closeAll()
+		return
 	}
 
-	return configs, nil
+	manager.cancel()
+	<-manager.done
 }
 
 // Do check member is still connected or not
-func (manager *Manager) tick() {
+func (manager *Manager) tick(ctx context.Context) {
 	manager.debug("Start ticker to maintenance tunnels connection.....")
 
 	t := ticker.NewConstant(manager.interval)
@@ -237,85 +436,17 @@ func (manager *Manager) tick() {
 	}
 	defer t.Stop()
 
-	for range t.C {
-		newConfigs, err := manager.getNewConfig()
-		if err != nil {
-			manager.logger().Error("Error fetching config from remote", zap.Error(err))
-		}
-
-		// compare new config with old config
-		for _, newConfig := range newConfigs {
-			found := false
-			for index, oldConfig := range manager.configs {
-				if newConfig.ID == oldConfig.ID {
-					found = true
-
-					// update config based on remote config
-					manager.configs[index].TunnelHost = newConfig.TunnelHost
-					manager.configs[index].TunnelPort = newConfig.TunnelPort
-					manager.configs[index].ListenerHost = newConfig.ListenerHost
-					manager.configs[index].ListenerPort = newConfig.ListenerPort
-					manager.configs[index].ServiceHost = newConfig.ServiceHost
-					manager.configs[index].ServicePort = newConfig.ServicePort
-					manager.configs[index].State = newConfig.State
-
-					continue
-				}
-			}
-			if !found {
-				// add new config if state is active
-				if newConfig.State == ConfigStateActive {
-					manager.configs = append(manager.configs, newConfig)
-				}
-			}
-		}
-
-		// temporary array to store new config, copy array to tempArray
-		for index, config := range manager.configs {
-			// reconfigure connection if remote config is active
-			if config.State == ConfigStateActive {
-				if config.connection == nil {
-					// set new connection
-					manager.configs[index].connection = manager.createNewConnection(config)
-
-					go func() {
-						// start new connection!
-						err := manager.configs[index].connection.ListenAndServe()
-						if err != nil {
-							log.Println(err)
-						}
-					}()
-				}
-				if config.connection != nil {
-					manager.debug(fmt.Sprintf("Connection ID %s %s", config.connection.GetID(), config.connection.GetStateString()))
-
-					if config.connection.GetState() == tukiran.Closed ||
-						config.connection.GetState() == tukiran.Idle ||
-						config.connection.GetState() == tukiran.Error {
-						manager.debug(fmt.Sprintf("Connection ID %s is %s, try to reconnect", config.connection.GetID(), config.connection.GetStateString()))
-						manager.configs[index].connection = manager.createNewConnection(config)
-
-						go func() {
-							// start new connection!
-							err := manager.configs[index].connection.ListenAndServe()
-							if err != nil {
-								manager.logger().Error("Error reconnecting connection", zap.Error(err))
-							}
-						}()
-					}
-				}
-			}
-
-			// delete connection if remote config is inactive
-			if config.State == ConfigStateInactive {
-				if config.connection != nil {
-					config.connection.Close()
-					manager.configs[index].connection = nil
-				}
-
-				// delete index from new array
-				manager.configs = append(manager.configs[:index], manager.configs[index+1:]...)
-			}
+	for {
+		select {
+		case <-ctx.Done():
+			manager.debug("Stop ticker to maintenance tunnels connection.....")
+			return
+		case <-manager.reload:
+			manager.debug("Reloading config.....")
+			manager.apply(manager.fetchProviders(ctx, false))
+		case <-t.C:
+			// watched providers are only fetched on change, unchanged config keeps current config
+			manager.apply(manager.fetchProviders(ctx, true))
 		}
 	}
 }
@@ -1,6 +1,8 @@
 package marijan
 
 import (
+	"crypto/ed25519"
+	"net/http"
 	"time"
 
 	"go.uber.org/zap"
@@ -42,3 +44,166 @@ func WithLogger(logger *zap.Logger) func(*Manager) {
 		conf.zap = logger
 	}
 }
+
+// set known_hosts file used by trust-on-first-use host key policy
+func WithKnownHostsFile(file string) func(*Manager) {
+	return func(conf *Manager) {
+		conf.knownHostsFile = file
+	}
+}
+
+// set reconnect backoff, delay starts at initial and doubles up to max with full jitter,
+// max of zero uses the default cap of 2 minutes
+func WithBackoff(initial time.Duration, max time.Duration) func(*Manager) {
+	return func(conf *Manager) {
+		conf.backoffInitial = initial
+		conf.backoffMax = max
+	}
+}
+
+// set how long a connection must stay up before reconnect backoff is reset
+func WithBackoffReset(resetAfter time.Duration) func(*Manager) {
+	return func(conf *Manager) {
+		conf.backoffResetAfter = resetAfter
+	}
+}
+
+// set how long in-flight connections are allowed to finish on shutdown, default is 30 seconds
+func WithDrainTimeout(timeout time.Duration) func(*Manager) {
+	return func(conf *Manager) {
+		conf.drainTimeout = timeout
+	}
+}
+
+// set config source as the full desired state, tunnels missing from source are stopped and removed
+func WithDeclarative(enabled bool) func(*Manager) {
+	return func(conf *Manager) {
+		conf.declarative = enabled
+	}
+}
+
+// allow empty config source to remove every tunnel in declarative mode, disabled by default
+// so a broken source does not wipe every tunnel
+func WithAllowEmpty(enabled bool) func(*Manager) {
+	return func(conf *Manager) {
+		conf.allowEmpty = enabled
+	}
+}
+
+// set config file to be watched for changes instead of read on every interval
+func WithWatch(enabled bool) func(*Manager) {
+	return func(conf *Manager) {
+		conf.watch = enabled
+	}
+}
+
+// set bearer token sent to remote config source
+func WithRemoteToken(token string) func(*Manager) {
+	return func(conf *Manager) {
+		conf.remote.Token = token
+	}
+}
+
+// add header sent to remote config source, can be used multiple times
+func WithRemoteHeader(name string, value string) func(*Manager) {
+	return func(conf *Manager) {
+		if conf.remote.Headers == nil {
+			conf.remote.Headers = http.Header{}
+		}
+		conf.remote.Headers.Add(name, value)
+	}
+}
+
+// set client certificate and key used for mTLS with remote config source
+func WithRemoteClientCert(certFile string, keyFile string) func(*Manager) {
+	return func(conf *Manager) {
+		conf.remote.CertFile = certFile
+		conf.remote.KeyFile = keyFile
+	}
+}
+
+// set CA bundle used to verify remote config source
+func WithRemoteCA(caFile string) func(*Manager) {
+	return func(conf *Manager) {
+		conf.remote.CAFile = caFile
+	}
+}
+
+// set agent version sent in User-Agent to remote config source
+func WithVersion(version string) func(*Manager) {
+	return func(conf *Manager) {
+		conf.remote.Version = version
+	}
+}
+
+// set server-sent events URL pushing config changes, remote config is polled while stream is down
+func WithStream(url string) func(*Manager) {
+	return func(conf *Manager) {
+		conf.remote.StreamURL = url
+	}
+}
+
+// set how long config stream may stay silent, heartbeats included, before it is reconnected
+func WithStreamIdleTimeout(timeout time.Duration) func(*Manager) {
+	return func(conf *Manager) {
+		conf.remote.StreamIdleTimeout = timeout
+	}
+}
+
+// set cache file of last known good remote config, used when remote is down on startup
+func WithCache(file string) func(*Manager) {
+	return func(conf *Manager) {
+		conf.remote.CacheFile = file
+	}
+}
+
+// require remote config to be signed by one of trusted Ed25519 keys
+func WithTrustedKeys(keys ...ed25519.PublicKey) func(*Manager) {
+	return func(conf *Manager) {
+		conf.remote.TrustedKeys = append(conf.remote.TrustedKeys, keys...)
+	}
+}
+
+// allow ${VAR} placeholders of remote config to read environment variables of names
+func WithRemoteSecretEnv(names ...string) func(*Manager) {
+	return func(conf *Manager) {
+		conf.remote.SecretEnv = append(conf.remote.SecretEnv, names...)
+	}
+}
+
+// allow ${file:...} placeholders of remote config to read secret files inside dirs
+func WithRemoteSecretDirs(dirs ...string) func(*Manager) {
+	return func(conf *Manager) {
+		conf.remote.SecretDirs = append(conf.remote.SecretDirs, dirs...)
+	}
+}
+
+// add config provider, providers added later take precedence over earlier ones and over
+// the provider of WithSource for tunnels with the same ID
+func WithProvider(providers ...ConfigProvider) func(*Manager) {
+	return func(conf *Manager) {
+		conf.providerList = append(conf.providerList, providers...)
+	}
+}
+
+// set address serving prometheus metrics on /metrics, such as localhost:9100
+func WithMetricsAddress(address string) func(*Manager) {
+	return func(conf *Manager) {
+		conf.metricsAddress = address
+	}
+}
+
+// set address serving admin API, such as localhost:9101 or a unix socket path like
+// /run/marijan/admin.sock. TCP address must be a loopback address and requires a token.
+func WithAdminAddress(address string) func(*Manager) {
+	return func(conf *Manager) {
+		conf.adminAddress = address
+	}
+}
+
+// set bearer token required by admin API
+func WithAdminToken(token string) func(*Manager) {
+	return func(conf *Manager) {
+		conf.adminToken = token
+	}
+}
@@ -0,0 +1,207 @@
+package marijan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+// tunnel states reported by marijan_tunnel_state
+var tunnelStates = []string{"Idle", "Connecting", "Connected", "Closed", "Error", "Paused"}
+
+// prometheus metrics of manager, tunnels report to it as tukiran observer
+type metrics struct {
+	registry            *prometheus.Registry
+	reconnects          *prometheus.CounterVec
+	dialDuration        *prometheus.HistogramVec
+	accepted            *prometheus.CounterVec
+	active              *prometheus.GaugeVec
+	bytes               *prometheus.CounterVec
+	serviceDialFailures *prometheus.CounterVec
+	configFetches       *prometheus.CounterVec
+}
+
+func newMetrics(manager *Manager) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		reconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "marijan_tunnel_reconnects_total",
+			Help: "Number of times a tunnel connection was recreated.",
+		}, []string{"id"}),
+		dialDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "marijan_tunnel_dial_duration_seconds",
+			Help:    "Duration of dialing and SSH handshake with tunnel server.",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		}, []string{"id", "result"}),
+		accepted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "marijan_tunnel_connections_accepted_total",
+			Help: "Number of remote connections accepted and forwarded to local service.",
+		}, []string{"id"}),
+		active: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "marijan_tunnel_connections_active",
+			Help: "Number of forwarded connections currently open.",
+		}, []string{"id"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "marijan_tunnel_bytes_total",
+			Help: "Bytes forwarded, in is from remote connection to local service and out is back.",
+		}, []string{"id", "direction"}),
+		serviceDialFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "marijan_tunnel_service_dial_failures_total",
+			Help: "Number of accepted connections local service could not be dialed for.",
+		}, []string{"id"}),
+		configFetches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "marijan_config_fetches_total",
+			Help: "Number of config fetches per provider and result, success, not_modified or error.",
+		}, []string{"provider", "result"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		&stateCollector{manager: manager},
+		m.reconnects,
+		m.dialDuration,
+		m.accepted,
+		m.active,
+		m.bytes,
+		m.serviceDialFailures,
+		m.configFetches,
+	)
+
+	return m
+}
+
+func (m *metrics) Dialed(id string, duration time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.dialDuration.WithLabelValues(id, result).Observe(duration.Seconds())
+}
+
+func (m *metrics) ConnectionAccepted(id string) {
+	m.accepted.WithLabelValues(id).Inc()
+	m.active.WithLabelValues(id).Inc()
+}
+
+func (m *metrics) ConnectionClosed(id string) {
+	m.active.WithLabelValues(id).Dec()
+}
+
+func (m *metrics) ServiceDialFailed(id string) {
+	m.serviceDialFailures.WithLabelValues(id).Inc()
+}
+
+func (m *metrics) BytesIn(id string, n int) {
+	m.bytes.WithLabelValues(id, "in").Add(float64(n))
+}
+
+func (m *metrics) BytesOut(id string, n int) {
+	m.bytes.WithLabelValues(id, "out").Add(float64(n))
+}
+
+// remove series of tunnel no longer managed, removed tunnels must not be reported forever
+func (m *metrics) forget(id string) {
+	m.reconnects.DeleteLabelValues(id)
+	m.dialDuration.DeleteLabelValues(id, "success")
+	m.dialDuration.DeleteLabelValues(id, "error")
+	m.accepted.DeleteLabelValues(id)
+	m.active.DeleteLabelValues(id)
+	m.bytes.DeleteLabelValues(id, "in")
+	m.bytes.DeleteLabelValues(id, "out")
+	m.serviceDialFailures.DeleteLabelValues(id)
+}
+
+// count config fetch of provider
+func (m *metrics) fetched(provider ConfigProvider, err error) {
+	result := "success"
+	switch {
+	case errors.Is(err, ErrNotModified):
+		result = "not_modified"
+	case err != nil:
+		result = "error"
+	}
+	m.configFetches.WithLabelValues(providerName(provider), result).Inc()
+}
+
+// reports state of every managed tunnel when scraped, removed tunnels disappear
+type stateCollector struct {
+	manager *Manager
+}
+
+var tunnelStateDesc = prometheus.NewDesc(
+	"marijan_tunnel_state",
+	"Current state of tunnel, 1 for the state tunnel is in and 0 for the others.",
+	[]string{"id", "state"}, nil,
+)
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tunnelStateDesc
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, status := range c.manager.Status() {
+		for _, state := range tunnelStates {
+			value := 0.0
+			if status.State == state {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(tunnelStateDesc, prometheus.GaugeValue, value, status.ID, strings.ToLower(state))
+		}
+	}
+}
+
+// MetricsHandler returns handler serving prometheus metrics of manager, to mount it on
+// an existing HTTP server instead of WithMetricsAddress
+func (manager *Manager) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(manager.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// listen on metrics address, nothing is served when address is empty
+func (manager *Manager) listenMetrics() error {
+	if manager.metricsAddress == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", manager.metricsAddress)
+	if err != nil {
+		return fmt.Errorf("Error listening metrics on %s: %v", manager.metricsAddress, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", manager.MetricsHandler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	manager.metricsServer = server
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			manager.logger().Error("Error serving metrics", zap.Error(err))
+		}
+	}()
+
+	manager.logger().Info(fmt.Sprintf("Serving metrics on http://%s/metrics", listener.Addr()))
+
+	return nil
+}
+
+// stop serving metrics
+func (manager *Manager) closeMetrics() {
+	if manager.metricsServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	manager.metricsServer.Shutdown(ctx)
+	manager.metricsServer = nil
+}
@@ -0,0 +1,152 @@
+package marijan
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMetrics_Endpoint(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find free port: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	manager := NewManager(
+		WithProvider(staticProvider{testTunnel("web")}),
+		WithInterval(time.Hour),
+		WithMetricsAddress(address),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- manager.Run(ctx)
+	}()
+
+	// traffic is reported by tukiran forwarder
+	manager.metrics.ConnectionAccepted("web")
+	manager.metrics.BytesIn("web", 10)
+	manager.metrics.BytesOut("web", 20)
+
+	expected := []string{
+		`marijan_tunnel_state{id="web",state="error"} 1`,
+		`marijan_tunnel_dial_duration_seconds_count{id="web",result="error"} 1`,
+		`marijan_tunnel_connections_accepted_total{id="web"} 1`,
+		`marijan_tunnel_connections_active{id="web"} 1`,
+		`marijan_tunnel_bytes_total{direction="in",id="web"} 10`,
+		`marijan_tunnel_bytes_total{direction="out",id="web"} 20`,
+		`marijan_config_fetches_total{provider="marijan.staticProvider",result="success"} 1`,
+	}
+
+	waitFor(t, "metrics of tunnel", func() bool {
+		resp, err := http.Get("http://" + address + "/metrics")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		for _, line := range expected {
+			if !strings.Contains(string(body), line) {
+				return false
+			}
+		}
+		return true
+	})
+
+	cancel()
+	if err := <-result; err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err := http.Get("http://" + address + "/metrics"); err == nil {
+		t.Fatalf("Expected metrics server to be closed after Run returned")
+	}
+}
+
+// scrape metrics of manager
+func scrapeMetrics(manager *Manager) string {
+	recorder := httptest.NewRecorder()
+	manager.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return recorder.Body.String()
+}
+
+func TestMetrics_FetchNotDue(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+
+	manager := NewManager(
+		WithSource(ConfigSourceRemote),
+		WithURL(server.URL),
+		WithInterval(20*time.Millisecond),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- manager.Run(ctx)
+	}()
+
+	// polls are skipped while max-age did not pass
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	<-result
+
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("Expected 1 request, got %d", n)
+	}
+
+	body := scrapeMetrics(manager)
+	if !strings.Contains(body, `marijan_config_fetches_total{provider="remote `+server.URL+`",result="success"} 1`) {
+		t.Fatalf("Expected 1 successful fetch, got:\n%s", body)
+	}
+	if strings.Contains(body, `result="not_modified"`) {
+		t.Fatalf("Expected skipped fetches not to be counted, got:\n%s", body)
+	}
+}
+
+func TestMetrics_RemovedTunnel(t *testing.T) {
+	manager := NewManager(
+		WithProvider(staticProvider{testTunnel("web")}),
+		WithInterval(time.Hour),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- manager.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-result
+	}()
+
+	manager.metrics.ConnectionAccepted("web")
+	manager.metrics.BytesIn("web", 10)
+	manager.metrics.ServiceDialFailed("web")
+	waitFor(t, "metrics of tunnel", func() bool {
+		return strings.Contains(scrapeMetrics(manager), `marijan_tunnel_dial_duration_seconds_count{id="web",result="error"}`)
+	})
+
+	if err := manager.RemoveTunnel("web"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	waitFor(t, "series of removed tunnel to be deleted", func() bool {
+		return !strings.Contains(scrapeMetrics(manager), `id="web"`)
+	})
+}
@@ -0,0 +1,323 @@
+package marijan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ConfigProvider fetches tunnel configs for the manager, such as a config file, a remote
+// endpoint or a database. Fetch returns ErrNotModified when config did not change since
+// the previous call, the previous configs are kept then.
+type ConfigProvider interface {
+	Fetch(ctx context.Context) ([]Config, error)
+}
+
+// ConfigWatcher is implemented by providers that notify about changes instead of being polled.
+// Watch returns a channel receiving a value on every change, the manager then calls Fetch.
+// The channel is closed when watching stops, the provider is polled meanwhile and Watch is
+// called again with backoff. Returning ErrWatchUnsupported stops watching for good.
+type ConfigWatcher interface {
+	Watch(ctx context.Context) (<-chan struct{}, error)
+}
+
+// ErrNotModified is returned by Fetch when config did not change
+var ErrNotModified = errors.New("config not modified")
+
+// errNotDue is returned by Fetch of built-in providers when a fetch is skipped because it is
+// not due yet, previous configs are kept and no fetch is counted
+var errNotDue = fmt.Errorf("config fetch not due: %w", ErrNotModified)
+
+// ErrWatchUnsupported is returned by Watch when provider can only be polled
+var ErrWatchUnsupported = errors.New("config watch not supported")
+
+// delay between Watch calls while provider is polled
+var watchBackoff = backoff{initial: time.Second, max: time.Minute}
+
+type forceFetchKey struct{}
+
+// mark fetch as explicit reload, providers should not skip it
+func withForceFetch(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forceFetchKey{}, true)
+}
+
+// check if fetch is an explicit reload
+func forceFetch(ctx context.Context) bool {
+	forced, _ := ctx.Value(forceFetchKey{}).(bool)
+	return forced
+}
+
+// logger of built-in providers, set by manager when provider is registered
+type providerLogger struct {
+	zap          *zap.Logger
+	debugEnabled bool
+}
+
+func (l *providerLogger) setLogger(logger *zap.Logger, debug bool) {
+	l.zap = logger
+	l.debugEnabled = debug
+}
+
+func (l *providerLogger) logger() *zap.Logger {
+	if l.zap == nil {
+		return zap.NewNop()
+	}
+
+	return l.zap.With(zap.Dict("module", zap.String("name", "marijan")))
+}
+
+func (l *providerLogger) debug(message string) {
+	if l.debugEnabled {
+		l.logger().Info(message)
+	}
+}
+
+// registered provider with its last fetched configs
+type providerState struct {
+	provider ConfigProvider
+	configs  []Config
+	// provider is watched and not polled, dirty provider is fetched on next reload
+	watched atomic.Bool
+	dirty   atomic.Bool
+}
+
+// get provider name for logs
+func providerName(provider ConfigProvider) string {
+	if stringer, ok := provider.(fmt.Stringer); ok {
+		return stringer.String()
+	}
+
+	return fmt.Sprintf("%T", provider)
+}
+
+// get provider of WithSource and WithURL
+func (manager *Manager) sourceProvider() (ConfigProvider, error) {
+	switch manager.source {
+	case ConfigSourceFile:
+		return NewFileProvider(manager.url, manager.watch), nil
+	case ConfigSourceRemote:
+		return NewRemoteProvider(manager.url, manager.remote), nil
+	}
+
+	return nil, fmt.Errorf("Unknown config source: %s", manager.source)
+}
+
+// register source provider and providers of WithProvider, later providers take precedence
+func (manager *Manager) setupProviders() error {
+	var providers []ConfigProvider
+
+	if manager.source != "" || len(manager.providerList) == 0 {
+		provider, err := manager.sourceProvider()
+		if err != nil {
+			return err
+		}
+		providers = append(providers, provider)
+	}
+	providers = append(providers, manager.providerList...)
+
+	states := make([]*providerState, 0, len(providers))
+	for _, provider := range providers {
+		if builtIn, ok := provider.(interface{ setLogger(*zap.Logger, bool) }); ok {
+			builtIn.setLogger(manager.zap, manager.debugEnabled)
+		}
+		states = append(states, &providerState{provider: provider})
+	}
+
+	// Reload may be called while starting, such as on SIGHUP
+	manager.mu.Lock()
+	manager.providers = states
+	manager.mu.Unlock()
+
+	return nil
+}
+
+// fetch config of every provider on startup, any error fails startup
+func (manager *Manager) fetchAll(ctx context.Context) ([]Config, error) {
+	for _, state := range manager.providers {
+		configs, err := state.provider.Fetch(withForceFetch(ctx))
+		manager.metrics.fetched(state.provider, err)
+		if err != nil && !errors.Is(err, ErrNotModified) {
+			return nil, fmt.Errorf("Error fetching config from %s: %w", providerName(state.provider), err)
+		}
+		state.configs = configs
+	}
+
+	return manager.mergeProviders()
+}
+
+// fetch config of dirty providers, and of polled providers when due. Returns nil when nothing
+// changed, failing providers keep their previous configs.
+func (manager *Manager) fetchProviders(ctx context.Context, due bool) []Config {
+	changed := false
+
+	for _, state := range manager.providers {
+		fetchCtx := ctx
+		if state.dirty.Swap(false) {
+			fetchCtx = withForceFetch(ctx)
+		} else if !due || state.watched.Load() {
+			continue
+		}
+
+		configs, err := state.provider.Fetch(fetchCtx)
+		if errors.Is(err, errNotDue) {
+			continue
+		}
+		manager.metrics.fetched(state.provider, err)
+		if errors.Is(err, ErrNotModified) {
+			manager.debug(fmt.Sprintf("Config from %s not modified", providerName(state.provider)))
+			continue
+		}
+		if err != nil {
+			manager.logger().Error("Error fetching config", zap.String("provider", providerName(state.provider)), zap.Error(err))
+			continue
+		}
+
+		state.configs = configs
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	merged, err := manager.mergeProviders()
+	if err != nil {
+		manager.logger().Error("Invalid merged config, keeping current config", zap.Error(err))
+		return nil
+	}
+
+	return merged
+}
+
+// merge configs of every provider per tunnel ID, later providers take precedence.
+// Fields set by a later provider override the same fields of earlier providers, tunnels
+// of custom providers without field information replace the whole tunnel.
+func (manager *Manager) mergeProviders() ([]Config, error) {
+	merged := []Config{}
+	index := map[string]int{}
+
+	for _, state := range manager.providers {
+		layer := providerName(state.provider)
+
+		for _, config := range state.configs {
+			paths := config.fields
+			if paths == nil {
+				paths = nonZeroPaths(config)
+			}
+
+			position, exists := index[config.ID]
+			if !exists {
+				config.origins = nil
+				config.setOrigins(layer, paths)
+				index[config.ID] = len(merged)
+				merged = append(merged, config)
+				continue
+			}
+
+			if config.fields == nil {
+				config.origins = nil
+				config.setOrigins(layer, paths)
+				merged[position] = config
+				continue
+			}
+
+			base := merged[position]
+			overlaid, err := overlay(base, config)
+			if err != nil {
+				return nil, fmt.Errorf("Error merging tunnel %s from %s: %v", config.ID, layer, err)
+			}
+			overlaid.origins = base.origins
+			overlaid.setOrigins(layer, paths)
+			overlaid.secrets = overlaySecrets(base, config)
+			merged[position] = overlaid
+		}
+	}
+
+	// override layers hold partial tunnels, only the merged result is complete
+	defaultStates(merged)
+	if err := validateConfigs(merged); err != nil {
+		return nil, err
+	}
+
+	return merged, nil
+}
+
+// watch providers supporting it until ctx is done. The returned channel is closed once
+// every watch is stopped.
+func (manager *Manager) startWatch(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	watchers := 0
+
+	for _, state := range manager.providers {
+		watcher, ok := state.provider.(ConfigWatcher)
+		if !ok {
+			continue
+		}
+
+		watchers++
+		go func() {
+			defer func() { stopped <- struct{}{} }()
+			manager.watchProvider(ctx, state, watcher)
+		}()
+	}
+
+	go func() {
+		defer close(done)
+		for range watchers {
+			<-stopped
+		}
+	}()
+
+	return done
+}
+
+// reload provider on every change, provider is polled while watch is down
+func (manager *Manager) watchProvider(ctx context.Context, state *providerState, watcher ConfigWatcher) {
+	name := providerName(state.provider)
+	attempts := 0
+
+	for {
+		started := time.Now()
+
+		changes, err := watcher.Watch(ctx)
+		if errors.Is(err, ErrWatchUnsupported) {
+			return
+		}
+		if err == nil {
+			state.watched.Store(true)
+			for range changes {
+				state.dirty.Store(true)
+				manager.signalReload()
+			}
+			state.watched.Store(false)
+			err = errors.New("watch stopped")
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		// watch that stayed up for a while starts backoff again
+		if time.Since(started) > watchBackoff.max {
+			attempts = 0
+		}
+		attempts++
+		delay := watchBackoff.delay(attempts)
+
+		manager.logger().Warn("Error watching config, falling back to polling",
+			zap.String("provider", name),
+			zap.Error(err),
+			zap.Duration("retry_in", delay),
+		)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
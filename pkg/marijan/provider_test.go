@@ -0,0 +1,72 @@
+package marijan
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// provider returning fixed configs
+type staticProvider []Config
+
+func (provider staticProvider) Fetch(ctx context.Context) ([]Config, error) {
+	return provider, nil
+}
+
+func TestWithProvider_Precedence(t *testing.T) {
+	base := testTunnel("web")
+	override := testTunnel("web")
+	override.ServicePort = "8080"
+
+	file := writeConfigFile(t, `[]`)
+	manager := NewManager(
+		WithSource(ConfigSourceFile),
+		WithURL(file),
+		WithProvider(staticProvider{base, testTunnel("api")}, staticProvider{override}),
+	)
+
+	if err := manager.setupProviders(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(manager.providers) != 3 {
+		t.Fatalf("Expected source provider and 2 providers, got %d", len(manager.providers))
+	}
+
+	configs, err := manager.fetchAll(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(configs) != 2 || configs[0].ID != "web" || configs[0].ServicePort != "8080" || configs[1].ID != "api" {
+		t.Fatalf("Expected later provider to replace web, got %+v", configs)
+	}
+
+	// without source only providers of WithProvider are used
+	manager = NewManager(WithProvider(staticProvider{base}))
+	if err := manager.setupProviders(); err != nil || len(manager.providers) != 1 {
+		t.Fatalf("Expected single provider, got %d (%v)", len(manager.providers), err)
+	}
+}
+
+func TestReload_WhileStarting(t *testing.T) {
+	manager := NewManager(WithProvider(staticProvider{testTunnel("web")}), WithInterval(time.Hour))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 100 {
+			manager.Reload()
+		}
+	}()
+
+	if err := manager.load(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer manager.connCancel()
+	<-done
+
+	// reload after startup marks every provider dirty
+	manager.Reload()
+	if !manager.providers[0].dirty.Load() {
+		t.Fatalf("Expected provider to be marked dirty")
+	}
+}
@@ -0,0 +1,260 @@
+package marijan
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/devetek/tuman/pkg/tukiran"
+	"go.uber.org/zap"
+)
+
+// store configs fetched from source, nil keeps the previous ones, then reconcile managed tunnels
+func (manager *Manager) apply(source []Config) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if source != nil {
+		// an empty source is more likely a broken source than a request to stop everything
+		if manager.declarative && len(source) == 0 && len(manager.sourceConfigs) > 0 && !manager.allowEmpty {
+			manager.logger().Warn("Config source returned no tunnels, keeping current tunnels")
+		} else {
+			manager.sourceConfigs = source
+		}
+	}
+
+	manager.reconcile(manager.desired())
+	manager.maintain(time.Now())
+}
+
+// reconcile managed tunnels with the current desired state, used after runtime API changes
+func (manager *Manager) refresh() {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	manager.reconcile(manager.desired())
+	manager.maintain(time.Now())
+}
+
+// check if manager is running and connections can be started, must be called with lock held
+func (manager *Manager) running() bool {
+	return manager.connCtx != nil && manager.connCtx.Err() == nil && !manager.stopping
+}
+
+// get desired configs, tunnels changed through runtime API replace the whole source config, must be called with lock held
+func (manager *Manager) desired() []Config {
+	desired := make([]Config, 0, len(manager.sourceConfigs)+len(manager.overrides))
+	seen := make(map[string]bool, len(manager.sourceConfigs))
+
+	for _, config := range manager.sourceConfigs {
+		if override, ok := manager.overrides[config.ID]; ok {
+			config = override
+			config.origins = nil
+			config.setOrigins(runtimeLayer, nonZeroPaths(config))
+		}
+		seen[config.ID] = true
+		desired = append(desired, config)
+	}
+
+	// tunnels only known by runtime API, sorted to keep order stable
+	var ids []string
+	for id := range manager.overrides {
+		if !seen[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		config := manager.overrides[id]
+		config.origins = nil
+		config.setOrigins(runtimeLayer, nonZeroPaths(config))
+		desired = append(desired, config)
+	}
+
+	return desired
+}
+
+// get index of managed config by ID, -1 when not found, must be called with lock held
+func (manager *Manager) indexOf(id string) int {
+	for index, config := range manager.configs {
+		if config.ID == id {
+			return index
+		}
+	}
+
+	return -1
+}
+
+// merge desired configs into managed configs, must be called with lock held
+func (manager *Manager) reconcile(desired []Config) {
+	for _, newConfig := range desired {
+		index := manager.indexOf(newConfig.ID)
+		if index >= 0 {
+			manager.update(index, newConfig)
+			continue
+		}
+
+		// add new config if state is active
+		if newConfig.State == ConfigStateActive {
+			manager.configs = append(manager.configs, newConfig)
+		}
+	}
+
+	if manager.declarative {
+		manager.prune(desired)
+	}
+}
+
+// mark managed configs missing from desired configs as inactive, must be called with lock held
+func (manager *Manager) prune(desired []Config) {
+	ids := make(map[string]bool, len(desired))
+	for _, config := range desired {
+		ids[config.ID] = true
+	}
+
+	for index, config := range manager.configs {
+		if !ids[config.ID] && config.State == ConfigStateActive {
+			manager.logger().Info(fmt.Sprintf("Connection ID %s is missing from config source, removing", config.ID))
+			manager.configs[index].State = ConfigStateInactive
+		}
+	}
+}
+
+// get settings used to establish connection, fields only used after connected are excluded
+func (config Config) connectionSettings() Config {
+	config.State = ""
+	config.ServiceHost = ""
+	config.ServicePort = ""
+	config.ReconnectInitial = 0
+	config.ReconnectMax = 0
+	config.ReconnectResetAfter = 0
+	config.connection = nil
+	config.reconnect = reconnectState{}
+	config.fields = nil
+	config.origins = nil
+	config.secrets = nil
+
+	return config
+}
+
+// update managed config at index, restart only the connection when its settings changed, must be called with lock held
+func (manager *Manager) update(index int, newConfig Config) {
+	current := manager.configs[index]
+
+	// keep runtime state of the connection
+	newConfig.connection = current.connection
+	newConfig.reconnect = current.reconnect
+	manager.configs[index] = newConfig
+
+	if current.connection == nil || newConfig.State != ConfigStateActive {
+		return
+	}
+
+	if !reflect.DeepEqual(current.connectionSettings(), newConfig.connectionSettings()) {
+		manager.logger().Info(fmt.Sprintf("Connection ID %s config changed, restarting connection", newConfig.ID))
+		current.connection.Close()
+
+		// restart right away, a config change is not a failure
+		manager.configs[index].connection = nil
+		manager.configs[index].reconnect = reconnectState{}
+		return
+	}
+
+	// service address is only used when dialing, ssh session can stay
+	if current.ServiceHost != newConfig.ServiceHost || current.ServicePort != newConfig.ServicePort {
+		// service address may be resolved from a secret
+		masked := newConfig.Masked()
+		manager.logger().Info(fmt.Sprintf("Connection ID %s service changed to %s:%s", newConfig.ID, masked.ServiceHost, masked.ServicePort))
+		current.connection.SetServiceAddress(newConfig.ServiceHost, newConfig.ServicePort)
+	}
+}
+
+// connect, reconnect and remove connections of managed configs, must be called with lock held
+func (manager *Manager) maintain(now time.Time) {
+	// connections are started once manager runs
+	for index, config := range manager.configs {
+		if config.State == ConfigStateActive && manager.running() {
+			manager.maintainConnection(index, now)
+		}
+	}
+
+	// delete connection if config is not active anymore
+	configs := make([]Config, 0, len(manager.configs))
+	for _, config := range manager.configs {
+		if config.State != ConfigStateActive {
+			if config.connection != nil {
+				config.connection.Close()
+			}
+			delete(manager.paused, config.ID)
+			manager.metrics.forget(config.ID)
+			continue
+		}
+		configs = append(configs, config)
+	}
+	manager.configs = configs
+}
+
+// connect or reconnect config at index, must be called with lock held
+func (manager *Manager) maintainConnection(index int, now time.Time) {
+	config := manager.configs[index]
+
+	// paused tunnel stays closed until resumed
+	if manager.paused[config.ID] {
+		if config.connection != nil {
+			config.connection.Close()
+			manager.configs[index].connection = nil
+		}
+		return
+	}
+
+	if config.connection == nil {
+		if !config.reconnect.ready(now) {
+			return
+		}
+
+		// set new connection
+		if err := manager.connect(index); err != nil {
+			manager.logger().Error("Error creating connection", zap.Error(err))
+		}
+		return
+	}
+
+	manager.debug(fmt.Sprintf("Connection ID %s %s", config.connection.GetID(), config.connection.GetStateString()))
+
+	if config.connection.GetState() == tukiran.Connected {
+		manager.configs[index].reconnect.connected(manager.backoffFor(config), now)
+	}
+
+	if !config.connection.IsRetryable() {
+		manager.debug(fmt.Sprintf("Connection ID %s failed permanently, skip reconnect: %v", config.connection.GetID(), config.connection.GetError()))
+		return
+	}
+
+	// Idle connection was just created and is not started yet, it is not a failure
+	if config.connection.GetState() == tukiran.Closed ||
+		config.connection.GetState() == tukiran.Error {
+		manager.configs[index].reconnect.failed(manager.backoffFor(config), now)
+		config = manager.configs[index]
+
+		if !config.reconnect.ready(now) {
+			// scheduled retry is logged once per attempt, later checks only in debug
+			if !config.reconnect.announced {
+				manager.configs[index].reconnect.announced = true
+				manager.logger().Info(fmt.Sprintf("Connection ID %s is %s, reconnect scheduled", config.connection.GetID(), config.connection.GetStateString()),
+					zap.Int("attempt", config.reconnect.attempts+1),
+					zap.Time("next_retry", config.reconnect.nextRetry))
+				return
+			}
+
+			manager.debug(fmt.Sprintf("Connection ID %s is %s, next retry at %s", config.connection.GetID(), config.connection.GetStateString(), config.reconnect.nextRetry.Format(time.RFC3339)))
+			return
+		}
+
+		manager.debug(fmt.Sprintf("Connection ID %s is %s, try to reconnect (attempt %d)", config.connection.GetID(), config.connection.GetStateString(), config.reconnect.attempts+1))
+		if err := manager.connect(index); err != nil {
+			manager.logger().Error("Error reconnecting connection", zap.Error(err))
+		}
+	}
+}
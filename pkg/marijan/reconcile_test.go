@@ -0,0 +1,304 @@
+package marijan
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devetek/tuman/pkg/tukiran"
+	gliderssh "github.com/gliderlabs/ssh"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// listener delaying every accepted connection, the ssh handshake waits meanwhile
+type delayedListener struct {
+	net.Listener
+	delay time.Duration
+}
+
+func (l delayedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	time.Sleep(l.delay)
+	return conn, err
+}
+
+// create ssh server supporting remote port forwarding, clients are not authenticated
+// unless auth handlers are set
+func newTunnelServer() *gliderssh.Server {
+	forwardHandler := &gliderssh.ForwardedTCPHandler{}
+
+	return &gliderssh.Server{
+		ReversePortForwardingCallback: func(ctx gliderssh.Context, host string, port uint32) bool {
+			return true
+		},
+		RequestHandlers: map[string]gliderssh.RequestHandler{
+			"tcpip-forward":        forwardHandler.HandleSSHRequest,
+			"cancel-tcpip-forward": forwardHandler.HandleSSHRequest,
+		},
+	}
+}
+
+// start ssh server supporting remote port forwarding answering handshake after delay, returns its port
+func startDelayedTunnelServer(t *testing.T, delay time.Duration) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	server := newTunnelServer()
+	go server.Serve(delayedListener{listener, delay})
+	t.Cleanup(func() { server.Close() })
+
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// start local tcp echo service, returns its port
+func startEchoService(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// get a free local tcp port
+func freePort(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find free port: %v", err)
+	}
+	defer listener.Close()
+
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// tunnel config forwarding a free port of tunnel server to local echo service
+func forwardedTunnel(t *testing.T, id string, tunnelPort string) Config {
+	return Config{
+		ID:           id,
+		TunnelHost:   "127.0.0.1",
+		TunnelPort:   tunnelPort,
+		ListenerHost: "127.0.0.1",
+		ListenerPort: freePort(t),
+		ServiceHost:  "127.0.0.1",
+		ServicePort:  startEchoService(t),
+		State:        ConfigStateActive,
+	}
+}
+
+func TestUpdate_ServiceOnlyKeepsConnection(t *testing.T) {
+	manager := NewManager()
+	config := testTunnel("service")
+	config.connection = tukiran.NewTunnelRemoteForwarder()
+	manager.configs = []Config{config}
+
+	changed := testTunnel("service")
+	changed.ServicePort = "4000"
+	manager.update(0, changed)
+
+	if manager.configs[0].connection != config.connection {
+		t.Fatalf("Expected connection to be kept for service-only change")
+	}
+	if manager.configs[0].ServicePort != "4000" {
+		t.Fatalf("Expected service port to be updated, got %s", manager.configs[0].ServicePort)
+	}
+}
+
+func TestUpdate_ServiceChangeLogMasksSecrets(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	manager := NewManager(WithLogger(zap.New(core)))
+	config := testTunnel("service")
+	config.connection = tukiran.NewTunnelRemoteForwarder()
+	manager.configs = []Config{config}
+
+	// service host resolved from environment
+	changed := testTunnel("service")
+	changed.ServiceHost = "internal.secret.example"
+	changed.secrets = []string{"service_host"}
+	manager.update(0, changed)
+
+	for _, entry := range logs.FilterMessageSnippet("service changed").AllUntimed() {
+		if strings.Contains(entry.Message, "internal.secret.example") || !strings.Contains(entry.Message, secretMask) {
+			t.Fatalf("Expected service host to be masked, got %q", entry.Message)
+		}
+		return
+	}
+	t.Fatalf("Expected service change to be logged")
+}
+
+func TestUpdate_TunnelChangeRestartsConnection(t *testing.T) {
+	manager := NewManager()
+	config := testTunnel("tunnel")
+	config.connection = tukiran.NewTunnelRemoteForwarder()
+	config.reconnect.attempts = 3
+	manager.configs = []Config{config}
+
+	changed := testTunnel("tunnel")
+	changed.TunnelHost = "tunnel.example.com"
+	manager.update(0, changed)
+
+	if manager.configs[0].connection != nil {
+		t.Fatalf("Expected connection to be restarted for tunnel host change")
+	}
+	if manager.configs[0].reconnect.attempts != 0 {
+		t.Fatalf("Expected reconnect backoff to be reset")
+	}
+}
+
+func TestUpdate_SameConfigKeepsConnection(t *testing.T) {
+	manager := NewManager()
+	config := testTunnel("same")
+	config.connection = tukiran.NewTunnelRemoteForwarder()
+	manager.configs = []Config{config}
+
+	manager.update(0, testTunnel("same"))
+
+	if manager.configs[0].connection != config.connection {
+		t.Fatalf("Expected connection to be kept when nothing changed")
+	}
+}
+
+func TestApply_DeclarativeRemovesMissing(t *testing.T) {
+	manager := NewManager(WithDeclarative(true))
+
+	manager.apply([]Config{testTunnel("first"), testTunnel("second")})
+	if len(manager.GetCurrentConfigs()) != 2 {
+		t.Fatalf("Expected 2 tunnels, got %d", len(manager.GetCurrentConfigs()))
+	}
+
+	manager.apply([]Config{testTunnel("second")})
+	configs := manager.GetCurrentConfigs()
+	if len(configs) != 1 || configs[0].ID != "second" {
+		t.Fatalf("Expected only second tunnel left, got %+v", configs)
+	}
+
+	// failed fetch keeps tunnels
+	manager.apply(nil)
+	if len(manager.GetCurrentConfigs()) != 1 {
+		t.Fatalf("Expected tunnel kept on failed fetch")
+	}
+
+	// empty fetch keeps tunnels unless allowed
+	manager.apply([]Config{})
+	if len(manager.GetCurrentConfigs()) != 1 {
+		t.Fatalf("Expected tunnel kept on empty fetch")
+	}
+
+	manager.allowEmpty = true
+	manager.apply([]Config{})
+	if len(manager.GetCurrentConfigs()) != 0 {
+		t.Fatalf("Expected every tunnel removed when empty source is allowed")
+	}
+}
+
+func TestApply_NonDeclarativeKeepsMissing(t *testing.T) {
+	manager := NewManager()
+
+	manager.apply([]Config{testTunnel("first"), testTunnel("second")})
+	manager.apply([]Config{testTunnel("second")})
+
+	if len(manager.GetCurrentConfigs()) != 2 {
+		t.Fatalf("Expected missing tunnel to be kept, got %d tunnels", len(manager.GetCurrentConfigs()))
+	}
+}
+
+func TestUpdate_ChangeWhileConnecting(t *testing.T) {
+	config := forwardedTunnel(t, "web", startDelayedTunnelServer(t, 300*time.Millisecond))
+	manager := NewManager(WithProvider(staticProvider{config}), WithInterval(time.Hour))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- manager.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-result
+	}()
+
+	var old *tukiran.TunnelForwarder
+	waitFor(t, "first connection to dial", func() bool {
+		current, _ := manager.GetTunnel("web")
+		old = current.connection
+		return old != nil && old.GetState() == tukiran.Connecting
+	})
+
+	// tunnel user is a connection setting, connection is restarted mid-dial
+	changed := config
+	changed.TunnelUser = "other"
+	if err := manager.UpdateTunnel(changed); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	current, _ := manager.GetTunnel("web")
+	if current.connection == nil || current.connection == old {
+		t.Fatalf("Expected connection to be restarted")
+	}
+	waitFor(t, "new connection to connect", func() bool {
+		return current.connection.GetState() == tukiran.Connected
+	})
+
+	// old forwarder must not finish its handshake and keep the remote port
+	time.Sleep(500 * time.Millisecond)
+	if old.GetState() != tukiran.Closed {
+		t.Fatalf("Expected old connection to be closed, got %s", old.GetStateString())
+	}
+	if current.connection.GetState() != tukiran.Connected {
+		t.Fatalf("Expected new connection to serve, got %s (%v)", current.connection.GetStateString(), current.connection.GetError())
+	}
+
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+config.ListenerPort, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial tunnel listener: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("ping"))
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("Expected echo reply through new connection, got %q (%v)", reply, err)
+	}
+}
+
+func TestMaintainConnection_IdleIsNotFailure(t *testing.T) {
+	manager := NewManager()
+	config := testTunnel("idle")
+	// connection is created but ListenAndServe goroutine did not start yet
+	config.connection = tukiran.NewTunnelRemoteForwarder()
+	manager.configs = []Config{config}
+
+	manager.maintainConnection(0, time.Now())
+
+	if manager.configs[0].connection != config.connection {
+		t.Fatalf("Expected idle connection to be kept")
+	}
+	if reconnect := manager.configs[0].reconnect; reconnect.attempts != 0 || !reconnect.nextRetry.IsZero() {
+		t.Fatalf("Expected no reconnect scheduled for idle connection, got %+v", reconnect)
+	}
+}
@@ -0,0 +1,156 @@
+package marijan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// last known good remote config, raw response and its signature header are kept so it is
+// verified, decoded and validated again
+type remoteCache struct {
+	FetchedAt time.Time    `json:"fetched_at"`
+	URL       string       `json:"url"`
+	Format    configFormat `json:"format"`
+	Signature string       `json:"signature,omitempty"`
+	Config    string       `json:"config"`
+}
+
+// write fetched remote config to cache file, temporary file is renamed so readers never see partial writes
+func (provider *RemoteProvider) writeCache(body []byte, format configFormat, signature string, fetchedAt time.Time) error {
+	if provider.options.CacheFile == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(remoteCache{
+		FetchedAt: fetchedAt,
+		URL:       provider.url,
+		Format:    format,
+		Signature: signature,
+		Config:    string(body),
+	})
+	if err != nil {
+		return err
+	}
+
+	file := expandHome(provider.options.CacheFile)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return fmt.Errorf("Error creating cache directory: %v", err)
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(file), ".cache-*")
+	if err != nil {
+		return fmt.Errorf("Error creating cache file: %v", err)
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return fmt.Errorf("Error writing cache file: %v", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("Error writing cache file: %v", err)
+	}
+
+	return os.Rename(temp.Name(), file)
+}
+
+// read cache file of current remote config
+func (provider *RemoteProvider) openCache() (remoteCache, error) {
+	var cache remoteCache
+
+	if provider.options.CacheFile == "" {
+		return cache, errors.New("Remote config cache is not enabled")
+	}
+
+	data, err := os.ReadFile(expandHome(provider.options.CacheFile))
+	if err != nil {
+		return cache, fmt.Errorf("Error reading cache file: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return cache, fmt.Errorf("Error unmarshalling cache file: %v", err)
+	}
+
+	// cache of another remote config must not be used
+	if cache.URL != provider.url {
+		return cache, fmt.Errorf("Cache file belongs to %s", cache.URL)
+	}
+
+	return cache, nil
+}
+
+// read cached remote config document, signature is verified again so an edited cache is rejected
+func (provider *RemoteProvider) readCacheDocument() (Document, time.Time, error) {
+	cache, err := provider.openCache()
+	if err != nil {
+		return Document{}, time.Time{}, err
+	}
+
+	payload, format, err := provider.verifyConfig([]byte(cache.Config), cache.Format, cache.Signature)
+	if err != nil {
+		return Document{}, time.Time{}, fmt.Errorf("Invalid cached config: %v", err)
+	}
+
+	document, err := decodeDocument(payload, format, provider.secretPolicy())
+	if err != nil {
+		return Document{}, time.Time{}, fmt.Errorf("Invalid cached config: %v", err)
+	}
+
+	return document, cache.FetchedAt, nil
+}
+
+// read revision of cached remote config
+func (provider *RemoteProvider) readCacheRevision() (uint64, error) {
+	document, _, err := provider.readCacheDocument()
+	if err != nil {
+		return 0, err
+	}
+
+	return document.Revision, nil
+}
+
+// read last known good remote config from cache file
+func (provider *RemoteProvider) readCache() ([]Config, time.Time, error) {
+	document, fetchedAt, err := provider.readCacheDocument()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return document.Tunnels, fetchedAt, nil
+}
+
+// use cached remote config when remote config can not be fetched on startup
+func (provider *RemoteProvider) loadCache(fetchErr error) ([]Config, error) {
+	configs, fetchedAt, err := provider.readCache()
+	if err != nil {
+		provider.debug(fmt.Sprintf("No cached remote config: %v", err))
+		return nil, fetchErr
+	}
+
+	provider.state.fetchedAt = fetchedAt
+	provider.logger().Warn("Error fetching remote config, using cached config",
+		zap.Error(fetchErr),
+		zap.Time("fetched_at", fetchedAt),
+		zap.Duration("age", time.Since(fetchedAt).Round(time.Second)),
+	)
+
+	return configs, nil
+}
+
+// log how old the remote config in use is after a failed fetch
+func (provider *RemoteProvider) logStale() {
+	if provider.state.fetchedAt.IsZero() {
+		return
+	}
+
+	provider.logger().Warn("Using last known good remote config",
+		zap.Time("fetched_at", provider.state.fetchedAt),
+		zap.Duration("age", time.Since(provider.state.fetchedAt).Round(time.Second)),
+	)
+}
@@ -0,0 +1,52 @@
+package marijan
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoad_CacheFallback(t *testing.T) {
+	cache := filepath.Join(t.TempDir(), "cache", "remote-config.json")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(watchedTunnel))
+	}))
+
+	provider := NewRemoteProvider(server.URL, RemoteOptions{CacheFile: cache})
+	if _, err := provider.Fetch(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// remote is down on next startup
+	server.Close()
+
+	manager := NewManager(WithSource(ConfigSourceRemote), WithURL(server.URL), WithCache(cache), WithInterval(time.Hour))
+	if err := manager.load(context.Background()); err != nil {
+		t.Fatalf("Expected cached config to be used, got %v", err)
+	}
+	defer manager.connCancel()
+
+	if _, ok := manager.GetTunnel("watched"); !ok {
+		t.Fatalf("Expected tunnel from cached config")
+	}
+	fetchedAt := manager.providers[0].provider.(*RemoteProvider).state.fetchedAt
+	if fetchedAt.IsZero() || time.Since(fetchedAt) > time.Minute {
+		t.Fatalf("Expected fetch time restored from cache, got %v", fetchedAt)
+	}
+
+	// cache of another URL is ignored
+	manager = NewManager(WithSource(ConfigSourceRemote), WithURL(server.URL+"/other"), WithCache(cache))
+	if err := manager.load(context.Background()); err == nil {
+		t.Fatalf("Expected error without usable cache")
+	}
+
+	// without cache startup fails like before
+	manager = NewManager(WithSource(ConfigSourceRemote), WithURL(server.URL))
+	if err := manager.load(context.Background()); err == nil {
+		t.Fatalf("Expected error without cache")
+	}
+}
@@ -0,0 +1,288 @@
+package marijan
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// wait for writes to settle before reloading, editors save in several steps
+const fileWatchDebounce = 200 * time.Millisecond
+
+// config document read from a single file
+type fileDocument struct {
+	path     string
+	document Document
+}
+
+// check if config path is a glob pattern
+func isGlob(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// check if file is hidden, like shells hidden files are not matched by patterns
+func isHidden(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), ".")
+}
+
+// check if file in config directory is a config file, hidden and unknown files are skipped
+func isConfigFile(name string) bool {
+	if isHidden(name) {
+		return false
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".yaml", ".yml", ".toml":
+		return true
+	}
+
+	return false
+}
+
+// get config files of config path in lexical order. The path is either a single file,
+// a directory with config files or a glob pattern.
+func configFiles(name string) ([]string, error) {
+	if isGlob(name) {
+		matches, err := filepath.Glob(name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid config pattern %s: %v", name, err)
+		}
+
+		files := make([]string, 0, len(matches))
+		for _, match := range matches {
+			if isHidden(match) {
+				continue
+			}
+			if info, err := os.Stat(match); err == nil && !info.IsDir() {
+				files = append(files, match)
+			}
+		}
+		sort.Strings(files)
+
+		return files, nil
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading file: %v", err)
+	}
+	if !info.IsDir() {
+		return []string{name}, nil
+	}
+
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading directory: %v", err)
+	}
+
+	// os.ReadDir returns entries sorted by file name
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && isConfigFile(entry.Name()) {
+			files = append(files, filepath.Join(name, entry.Name()))
+		}
+	}
+
+	return files, nil
+}
+
+// read config documents of config path in lexical order, partial documents hold overrides
+func readDocuments(name string, partial bool) ([]fileDocument, error) {
+	files, err := configFiles(name)
+	if err != nil {
+		return nil, err
+	}
+
+	documents := make([]fileDocument, 0, len(files))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading file: %v", err)
+		}
+
+		decode := decodeFileDocument
+		if partial {
+			decode = decodeOverrides
+		}
+
+		document, err := decode(data, formatFromPath(file))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid config %s: %v", file, err)
+		}
+
+		documents = append(documents, fileDocument{path: file, document: document})
+	}
+
+	return documents, nil
+}
+
+// FileProvider reads tunnel configs from a file, a directory of config files or a glob pattern
+type FileProvider struct {
+	providerLogger
+	path  string
+	watch bool
+	// tunnels only set the fields they override
+	override bool
+}
+
+// NewFileProvider creates provider reading config path, changes are watched when watch is set
+func NewFileProvider(path string, watch bool) *FileProvider {
+	return &FileProvider{path: path, watch: watch}
+}
+
+// NewOverrideProvider creates provider reading local overrides from config path. Tunnels only
+// need id and the fields they override, so it must be added after the provider of the baseline.
+func NewOverrideProvider(path string, watch bool) *FileProvider {
+	return &FileProvider{path: path, watch: watch, override: true}
+}
+
+func (provider *FileProvider) String() string {
+	if provider.override {
+		return "override " + provider.path
+	}
+
+	return "file " + provider.path
+}
+
+// Fetch reads and merges config files in lexical order
+func (provider *FileProvider) Fetch(ctx context.Context) ([]Config, error) {
+	documents, err := readDocuments(provider.path, provider.override)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []Config
+	origins := make(map[string]string)
+
+	for _, file := range documents {
+		for _, config := range file.document.Tunnels {
+			if origin, ok := origins[config.ID]; ok {
+				return nil, fmt.Errorf("Invalid config %s: duplicate id %q, already defined in %s", file.path, config.ID, origin)
+			}
+			origins[config.ID] = file.path
+			configs = append(configs, config)
+		}
+	}
+
+	return configs, nil
+}
+
+// Watch notifies about config file changes until ctx is done. Parent directories are watched
+// so atomic saves, writing a temporary file then renaming it over the config, are detected.
+func (provider *FileProvider) Watch(ctx context.Context) (<-chan struct{}, error) {
+	if !provider.watch {
+		return nil, ErrWatchUnsupported
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := filepath.Abs(provider.path)
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	// check if changed file belongs to config
+	matches := func(name string) bool {
+		return filepath.Clean(name) == target
+	}
+
+	dirs := map[string]bool{}
+
+	switch info, statErr := os.Stat(target); {
+	case isGlob(target):
+		matches = func(name string) bool {
+			matched, _ := filepath.Match(target, filepath.Clean(name))
+			return matched && !isHidden(name)
+		}
+
+		// directories of a pattern may be a pattern as well, watch the ones matched now
+		if !isGlob(filepath.Dir(target)) {
+			dirs[filepath.Dir(target)] = true
+		}
+		files, _ := filepath.Glob(target)
+		for _, file := range files {
+			dirs[filepath.Dir(file)] = true
+		}
+	case statErr == nil && info.IsDir():
+		matches = func(name string) bool {
+			return filepath.Dir(filepath.Clean(name)) == target && isConfigFile(name)
+		}
+		dirs[target] = true
+	default:
+		dirs[filepath.Dir(target)] = true
+	}
+
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+
+	// debounce may still fire while watch stops, closed guards the channel
+	var mu sync.Mutex
+	closed := false
+	changes := make(chan struct{}, 1)
+	notify := func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if closed {
+			return
+		}
+		select {
+		case changes <- struct{}{}:
+		default:
+			// change already pending
+		}
+	}
+
+	go func() {
+		defer func() {
+			mu.Lock()
+			closed = true
+			close(changes)
+			mu.Unlock()
+		}()
+		defer watcher.Close()
+
+		debounce := time.AfterFunc(time.Hour, notify)
+		debounce.Stop()
+		defer debounce.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !matches(event.Name) || event.Op == fsnotify.Chmod {
+					continue
+				}
+
+				provider.debug(fmt.Sprintf("Config file %s changed (%s)", event.Name, event.Op))
+				debounce.Reset(fileWatchDebounce)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				provider.logger().Error("Error watching config file", zap.Error(err))
+			}
+		}
+	}()
+
+	return changes, nil
+}
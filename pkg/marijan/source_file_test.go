@@ -0,0 +1,90 @@
+package marijan
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const watchedTunnel = `[{"id": "watched", "tunnel_host": "127.0.0.1", "tunnel_port": "1", "listener_host": "localhost", "listener_port": "3001", "service_host": "localhost", "service_port": "3000", "state": "active"}]`
+
+func TestWatchFile_AtomicRename(t *testing.T) {
+	file := writeConfigFile(t, `[]`)
+	manager := NewManager(
+		WithSource(ConfigSourceFile),
+		WithURL(file),
+		WithInterval(time.Hour),
+		WithWatch(true),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- manager.Run(ctx)
+	}()
+
+	// wait for watcher to start, then save like an editor does
+	time.Sleep(100 * time.Millisecond)
+	temp := filepath.Join(filepath.Dir(file), ".config.json.swp")
+	if err := os.WriteFile(temp, []byte(watchedTunnel), 0600); err != nil {
+		t.Fatalf("Failed to write temporary file: %v", err)
+	}
+	if err := os.Rename(temp, file); err != nil {
+		t.Fatalf("Failed to rename temporary file: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := manager.GetTunnel("watched"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Config change was not picked up by watcher")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+}
+
+func TestGetConfigFromFile_Directory(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"20-api.yaml":  "- {id: api, tunnel_host: 127.0.0.1, tunnel_port: 1, listener_host: localhost, listener_port: 4001, service_host: localhost, service_port: 4000, state: active}",
+		"10-web.json":  `[{"id": "web", "tunnel_host": "127.0.0.1", "tunnel_port": "1", "listener_host": "localhost", "listener_port": "3001", "service_host": "localhost", "service_port": "3000", "state": "active"}]`,
+		"README.md":    "not a config",
+		".10-web.json": "not a config either",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	for _, url := range []string{dir, filepath.Join(dir, "*-*")} {
+		configs, err := NewFileProvider(url, false).Fetch(context.Background())
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", url, err)
+		}
+		if len(configs) != 2 || configs[0].ID != "web" || configs[1].ID != "api" {
+			t.Fatalf("Expected web and api in lexical order for %s, got %+v", url, configs)
+		}
+	}
+
+	// same id in another file is reported with both files
+	duplicate := filepath.Join(dir, "30-web.json")
+	if err := os.WriteFile(duplicate, []byte(files["10-web.json"]), 0600); err != nil {
+		t.Fatalf("Failed to write duplicate: %v", err)
+	}
+
+	_, err := NewFileProvider(dir, false).Fetch(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "30-web.json") || !strings.Contains(err.Error(), "10-web.json") {
+		t.Fatalf("Expected duplicate error naming both files, got %v", err)
+	}
+}
@@ -0,0 +1,324 @@
+package marijan
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// default version sent in User-Agent when WithVersion is not used
+const defaultVersion = "dev"
+
+// RemoteOptions holds remote config HTTP client settings
+type RemoteOptions struct {
+	// bearer token and custom headers sent with every request
+	Token   string
+	Headers http.Header
+	// client certificate and key for mTLS, CA bundle to verify server
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	// agent version sent in User-Agent
+	Version string
+	// last known good config, used when remote is down on startup
+	CacheFile string
+	// server-sent events URL pushing config changes, reconnected when idle for StreamIdleTimeout
+	StreamURL         string
+	StreamIdleTimeout time.Duration
+	// config must be signed by one of trusted keys
+	TrustedKeys []ed25519.PublicKey
+	// environment variables and directories placeholders of remote config may read secrets from
+	SecretEnv  []string
+	SecretDirs []string
+}
+
+// RemoteProvider fetches tunnel configs from remote HTTP endpoint
+type RemoteProvider struct {
+	providerLogger
+	url     string
+	options RemoteOptions
+	// HTTP client is built on first use, guarded by mu like pushed configs
+	mu     sync.Mutex
+	client *http.Client
+	// config pushed by stream, returned by next Fetch
+	current []Config
+	pushed  bool
+	// validators and poll delay, only used by Fetch
+	state       remoteState
+	revision    revisionGuard
+	lastEventID string
+}
+
+// NewRemoteProvider creates provider fetching config from url
+func NewRemoteProvider(url string, options RemoteOptions) *RemoteProvider {
+	return &RemoteProvider{url: url, options: options}
+}
+
+func (provider *RemoteProvider) String() string {
+	return "remote " + provider.url
+}
+
+// get what placeholders of remote config may read, nothing unless allowed
+func (provider *RemoteProvider) secretPolicy() secretPolicy {
+	return secretPolicy{restricted: true, dirs: provider.options.SecretDirs, env: provider.options.SecretEnv}
+}
+
+// validators and poll delay of last remote config response
+type remoteState struct {
+	etag         string
+	lastModified string
+	nextFetch    time.Time
+	// time of last remote config successfully fetched, also restored from cache
+	fetchedAt time.Time
+}
+
+// get delay requested by Cache-Control max-age and Retry-After headers
+func pollDelay(header http.Header, now time.Time) time.Duration {
+	var delay time.Duration
+
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(name, "max-age") {
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && seconds > 0 {
+				delay = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	// Retry-After is either seconds or HTTP date
+	if retryAfter := header.Get("Retry-After"); retryAfter != "" {
+		var retry time.Duration
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			retry = time.Duration(seconds) * time.Second
+		} else if date, err := http.ParseTime(retryAfter); err == nil {
+			retry = date.Sub(now)
+		}
+		delay = max(delay, retry)
+	}
+
+	return delay
+}
+
+// check if remote config should be fetched, servers may ask to poll less often
+func (provider *RemoteProvider) fetchDue(now time.Time) bool {
+	return !now.Before(provider.state.nextFetch)
+}
+
+// get User-Agent of remote config requests, marijan/<version> (<hostname>)
+func (provider *RemoteProvider) userAgent() string {
+	version := provider.options.Version
+	if version == "" {
+		version = defaultVersion
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return fmt.Sprintf("marijan/%s (%s)", version, hostname)
+}
+
+// get remote config HTTP client, TLS files are loaded on first use
+func (provider *RemoteProvider) httpClient() (*http.Client, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if provider.client != nil {
+		return provider.client, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if provider.options.CAFile != "" {
+		ca, err := os.ReadFile(expandHome(provider.options.CAFile))
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA bundle: %v", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("Error parsing CA bundle %s: no certificates found", provider.options.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if provider.options.CertFile != "" || provider.options.KeyFile != "" {
+		if provider.options.CertFile == "" || provider.options.KeyFile == "" {
+			return nil, fmt.Errorf("Client certificate and key must be set together")
+		}
+
+		// load on every handshake so rotated certificates are picked up
+		certFile, keyFile := expandHome(provider.options.CertFile), expandHome(provider.options.KeyFile)
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return nil, fmt.Errorf("Error loading client certificate: %v", err)
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	provider.client = &http.Client{
+		Timeout:   10 * time.Second, // Set a timeout for the request
+		Transport: transport,
+	}
+
+	return provider.client, nil
+}
+
+// create remote config request with auth and custom headers
+func (provider *RemoteProvider) newRequest(ctx context.Context, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating GET request: %v", err)
+	}
+
+	for name, values := range provider.options.Headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	if provider.options.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+provider.options.Token)
+	}
+
+	req.Header.Set("User-Agent", provider.userAgent())
+
+	return req, nil
+}
+
+// fetch remote config over HTTP
+func (provider *RemoteProvider) poll(ctx context.Context) ([]Config, error) {
+	var configs []Config
+
+	client, err := provider.httpClient()
+	if err != nil {
+		return configs, err
+	}
+
+	req, err := provider.newRequest(ctx, provider.url)
+	if err != nil {
+		return configs, err
+	}
+
+	// conditional request, server answers 304 when config did not change
+	if provider.state.etag != "" {
+		req.Header.Set("If-None-Match", provider.state.etag)
+	}
+	if provider.state.lastModified != "" {
+		req.Header.Set("If-Modified-Since", provider.state.lastModified)
+	}
+
+	// Make the GET request
+	resp, err := client.Do(req)
+	if err != nil {
+		return configs, fmt.Errorf("Error making GET request: %v", err)
+	}
+	defer resp.Body.Close() // Ensure the response body is closed
+
+	now := time.Now()
+	provider.state.nextFetch = now.Add(pollDelay(resp.Header, now))
+
+	if resp.StatusCode == http.StatusNotModified {
+		return configs, ErrNotModified
+	}
+
+	// Check the HTTP status code
+	if resp.StatusCode != http.StatusOK {
+		return configs, fmt.Errorf("Received non-OK HTTP status: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return configs, fmt.Errorf("Error reading response: %v", err)
+	}
+
+	// pick format from Content-Type, fall back to URL extension
+	format := formatFromContentType(resp.Header.Get("Content-Type"))
+	if format == "" {
+		format = formatFromPath(req.URL.Path)
+	}
+	responseFormat := format
+
+	signature := resp.Header.Get(signatureHeader)
+	payload, format, err := provider.verifyConfig(body, format, signature)
+	if err != nil {
+		return configs, err
+	}
+
+	document, err := decodeDocument(payload, format, provider.secretPolicy())
+	if err != nil {
+		return configs, fmt.Errorf("Invalid config response: %v", err)
+	}
+
+	if err := provider.acceptRevision(document.Revision); err != nil {
+		return configs, err
+	}
+	configs = document.Tunnels
+
+	provider.state.etag = resp.Header.Get("ETag")
+	provider.state.lastModified = resp.Header.Get("Last-Modified")
+	provider.state.fetchedAt = now
+
+	// raw response is cached, it is verified again when cache is read
+	if err := provider.writeCache(body, responseFormat, signature, now); err != nil {
+		provider.logger().Warn("Error writing remote config cache", zap.Error(err))
+	}
+
+	provider.mu.Lock()
+	provider.current = configs
+	provider.pushed = false
+	provider.mu.Unlock()
+
+	return configs, nil
+}
+
+// Fetch returns config pushed by stream, otherwise fetches remote config when due or forced.
+// The last known good config is used when remote is down on startup.
+func (provider *RemoteProvider) Fetch(ctx context.Context) ([]Config, error) {
+	provider.mu.Lock()
+	if provider.pushed {
+		provider.pushed = false
+		configs := make([]Config, len(provider.current))
+		copy(configs, provider.current)
+		provider.mu.Unlock()
+		return configs, nil
+	}
+	provider.mu.Unlock()
+
+	if !forceFetch(ctx) && !provider.fetchDue(time.Now()) {
+		return nil, errNotDue
+	}
+
+	configs, err := provider.poll(ctx)
+	if err == nil || errors.Is(err, ErrNotModified) {
+		return configs, err
+	}
+
+	if provider.state.fetchedAt.IsZero() {
+		return provider.loadCache(err)
+	}
+
+	provider.logStale()
+	return nil, err
+}
@@ -0,0 +1,120 @@
+package marijan
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetConfigFromRemote_Headers(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret-token" || r.Header.Get("X-Agent-Group") != "edge" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !strings.HasPrefix(r.Header.Get("User-Agent"), "marijan/1.2.3 (") {
+			http.Error(w, "bad user agent", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(watchedTunnel))
+	}))
+	defer server.Close()
+
+	// trust test server through CA bundle
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(ca, certPEM, 0600); err != nil {
+		t.Fatalf("Failed to write CA bundle: %v", err)
+	}
+
+	provider := NewRemoteProvider(server.URL, RemoteOptions{
+		CAFile:  ca,
+		Token:   "secret-token",
+		Headers: http.Header{"X-Agent-Group": {"edge"}},
+		Version: "1.2.3",
+	})
+
+	configs, err := provider.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(configs) != 1 || configs[0].ID != "watched" {
+		t.Fatalf("Unexpected configs: %+v", configs)
+	}
+
+	// without token the request is rejected
+	provider = NewRemoteProvider(server.URL, RemoteOptions{CAFile: ca})
+	if _, err := provider.Fetch(context.Background()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("Expected unauthorized error, got %v", err)
+	}
+}
+
+func TestGetConfigFromRemote_Conditional(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.Header().Set("Cache-Control", "public, max-age=60")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(watchedTunnel))
+	}))
+	defer server.Close()
+
+	provider := NewRemoteProvider(server.URL, RemoteOptions{})
+
+	if _, err := provider.Fetch(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !provider.fetchDue(time.Now()) {
+		t.Fatalf("Expected next fetch to be due without max-age")
+	}
+
+	if _, err := provider.Fetch(context.Background()); !errors.Is(err, ErrNotModified) {
+		t.Fatalf("Expected not modified, got %v", err)
+	}
+	if provider.fetchDue(time.Now().Add(59*time.Second)) || !provider.fetchDue(time.Now().Add(61*time.Second)) {
+		t.Fatalf("Expected next fetch after max-age, got %v", provider.state.nextFetch)
+	}
+
+	// polling waits for max-age, explicit reload does not
+	if _, err := provider.Fetch(context.Background()); !errors.Is(err, ErrNotModified) {
+		t.Fatalf("Expected fetch to be skipped, got %v", err)
+	}
+	if _, err := provider.Fetch(withForceFetch(context.Background())); !errors.Is(err, ErrNotModified) {
+		t.Fatalf("Expected forced fetch to reach server, got %v", err)
+	}
+	if requests != 3 {
+		t.Fatalf("Expected 3 requests, got %d", requests)
+	}
+}
+
+func TestPollDelay_RetryAfter(t *testing.T) {
+	now := time.Now()
+
+	header := http.Header{}
+	header.Set("Retry-After", "120")
+	header.Set("Cache-Control", "max-age=30")
+	if delay := pollDelay(header, now); delay != 2*time.Minute {
+		t.Fatalf("Expected Retry-After to win, got %v", delay)
+	}
+
+	header = http.Header{}
+	header.Set("Retry-After", now.Add(time.Hour).UTC().Format(http.TimeFormat))
+	if delay := pollDelay(header, now); delay < 59*time.Minute || delay > time.Hour {
+		t.Fatalf("Expected delay from HTTP date, got %v", delay)
+	}
+}
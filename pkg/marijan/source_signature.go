@@ -0,0 +1,160 @@
+package marijan
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// header carrying detached signature of remote config response
+const signatureHeader = "X-Config-Signature"
+
+// signed config envelope, signature is made over decoded payload
+type signedEnvelope struct {
+	Payload   string       `json:"payload"`
+	Signature string       `json:"signature"`
+	Format    configFormat `json:"format,omitempty"`
+}
+
+// highest config revision accepted, older revisions are rejected as rollback
+type revisionGuard struct {
+	mu       sync.Mutex
+	loaded   bool
+	revision uint64
+}
+
+// ParseTrustedKey parses Ed25519 public key, either raw key in base64 or OpenSSH
+// authorized_keys format such as `ssh-ed25519 AAAA... comment`
+func ParseTrustedKey(text string) (ed25519.PublicKey, error) {
+	text = strings.TrimSpace(text)
+
+	if strings.HasPrefix(text, "ssh-ed25519 ") {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(text))
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing trusted key: %v", err)
+		}
+		cryptoKey, ok := key.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil, errors.New("Error parsing trusted key: not an Ed25519 key")
+		}
+		publicKey, ok := cryptoKey.CryptoPublicKey().(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("Error parsing trusted key: not an Ed25519 key")
+		}
+		return publicKey, nil
+	}
+
+	raw, err := decodeBase64(text)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing trusted key: %v", err)
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Error parsing trusted key: Ed25519 key must be %d bytes, got %d", ed25519.PublicKeySize, len(raw))
+	}
+
+	return ed25519.PublicKey(raw), nil
+}
+
+// decode standard or URL-safe base64, with or without padding
+func decodeBase64(text string) ([]byte, error) {
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if decoded, err := encoding.DecodeString(text); err == nil {
+			return decoded, nil
+		}
+	}
+
+	return nil, errors.New("invalid base64")
+}
+
+// get signed envelope from body, false when body is not an envelope
+func parseEnvelope(body []byte) (signedEnvelope, bool) {
+	var envelope signedEnvelope
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&envelope); err != nil || envelope.Payload == "" || envelope.Signature == "" {
+		return envelope, false
+	}
+
+	return envelope, true
+}
+
+// check signature against trusted keys
+func (provider *RemoteProvider) verifySignature(payload []byte, signature string) error {
+	decoded, err := decodeBase64(strings.TrimSpace(signature))
+	if err != nil {
+		return fmt.Errorf("Invalid config signature: %v", err)
+	}
+
+	for _, key := range provider.options.TrustedKeys {
+		if ed25519.Verify(key, payload, decoded) {
+			return nil
+		}
+	}
+
+	return errors.New("Invalid config signature: not signed by a trusted key")
+}
+
+// unwrap signed envelope and verify signature when trusted keys are set, returns config document
+// and its format. Signature is taken from header when set, otherwise body must be an envelope.
+func (provider *RemoteProvider) verifyConfig(body []byte, format configFormat, signature string) ([]byte, configFormat, error) {
+	payload := body
+
+	if envelope, ok := parseEnvelope(body); ok {
+		decoded, err := decodeBase64(envelope.Payload)
+		if err != nil {
+			return nil, "", fmt.Errorf("Invalid config envelope: payload: %v", err)
+		}
+
+		payload, signature = decoded, envelope.Signature
+		format = configFormatJSON
+		if envelope.Format != "" {
+			format = envelope.Format
+		}
+	}
+
+	if len(provider.options.TrustedKeys) == 0 {
+		return payload, format, nil
+	}
+
+	if signature == "" {
+		return nil, "", fmt.Errorf("Config is not signed, expected %s header or signed envelope", signatureHeader)
+	}
+
+	if err := provider.verifySignature(payload, signature); err != nil {
+		return nil, "", err
+	}
+
+	return payload, format, nil
+}
+
+// accept config revision unless it is older than the highest revision seen, the highest
+// revision is restored from cache so a restart does not allow rollback either
+func (provider *RemoteProvider) acceptRevision(revision uint64) error {
+	guard := &provider.revision
+
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	if !guard.loaded {
+		guard.loaded = true
+		if cached, err := provider.readCacheRevision(); err == nil {
+			guard.revision = cached
+		}
+	}
+
+	if revision < guard.revision {
+		return fmt.Errorf("Config revision %d is older than accepted revision %d, possible rollback", revision, guard.revision)
+	}
+
+	guard.revision = revision
+
+	return nil
+}
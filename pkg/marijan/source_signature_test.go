@@ -0,0 +1,140 @@
+package marijan
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func signedDocument(revision int) string {
+	return fmt.Sprintf(`{"revision": %d, "tunnels": %s}`, revision, watchedTunnel)
+}
+
+func TestGetConfigFromRemote_Signature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+
+	var body, signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if signature != "" {
+			w.Header().Set(signatureHeader, signature)
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	provider := NewRemoteProvider(server.URL, RemoteOptions{TrustedKeys: []ed25519.PublicKey{publicKey}})
+	sign := func(key ed25519.PrivateKey, payload string) string {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(payload)))
+	}
+
+	steps := []struct {
+		name      string
+		body      string
+		signature string
+		expected  string
+	}{
+		{"unsigned", signedDocument(1), "", "not signed"},
+		{"untrusted key", signedDocument(1), sign(otherKey, signedDocument(1)), "not signed by a trusted key"},
+		{"tampered", strings.Replace(signedDocument(1), "127.0.0.1", "evil.example", 1), sign(privateKey, signedDocument(1)), "not signed by a trusted key"},
+		{"header", signedDocument(2), sign(privateKey, signedDocument(2)), ""},
+		{"envelope", fmt.Sprintf(`{"payload": %q, "signature": %q}`, base64.StdEncoding.EncodeToString([]byte(signedDocument(3))), sign(privateKey, signedDocument(3))), "", ""},
+		{"rollback", signedDocument(2), sign(privateKey, signedDocument(2)), "possible rollback"},
+	}
+
+	for _, step := range steps {
+		body, signature = step.body, step.signature
+
+		configs, err := provider.poll(context.Background())
+		if step.expected == "" {
+			if err != nil || len(configs) != 1 {
+				t.Fatalf("%s: expected valid config, got %v", step.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), step.expected) {
+			t.Fatalf("%s: expected error containing %q, got %v", step.name, step.expected, err)
+		}
+	}
+}
+
+func TestParseTrustedKey(t *testing.T) {
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	sshKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("Failed to convert key: %v", err)
+	}
+
+	for _, text := range []string{
+		base64.StdEncoding.EncodeToString(publicKey),
+		strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshKey))) + " config-signer",
+	} {
+		parsed, err := ParseTrustedKey(text)
+		if err != nil || !parsed.Equal(publicKey) {
+			t.Fatalf("Expected key to be parsed from %q, got %v", text, err)
+		}
+	}
+
+	if _, err := ParseTrustedKey("c2hvcnQ="); err == nil {
+		t.Fatalf("Expected error for short key")
+	}
+}
+
+func TestCache_SignatureVerifiedOnLoad(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	cache := filepath.Join(t.TempDir(), "remote-cache.json")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(signatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(signedDocument(5)))))
+		w.Write([]byte(signedDocument(5)))
+	}))
+	defer server.Close()
+
+	options := RemoteOptions{TrustedKeys: []ed25519.PublicKey{publicKey}, CacheFile: cache}
+	if _, err := NewRemoteProvider(server.URL, options).poll(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// revision after restart comes from the verified cached document
+	restarted := NewRemoteProvider(server.URL, options)
+	if configs, _, err := restarted.readCache(); err != nil || len(configs) != 1 {
+		t.Fatalf("Expected signed cache to be used, got %v", err)
+	}
+	if err := restarted.acceptRevision(4); err == nil || !strings.Contains(err.Error(), "possible rollback") {
+		t.Fatalf("Expected rollback below cached revision to be rejected, got %v", err)
+	}
+
+	// edited cache is neither used nor trusted for its revision
+	cached, err := restarted.openCache()
+	if err != nil {
+		t.Fatalf("Failed to read cache: %v", err)
+	}
+	if err := restarted.writeCache([]byte(signedDocument(9)), cached.Format, cached.Signature, cached.FetchedAt); err != nil {
+		t.Fatalf("Failed to write cache: %v", err)
+	}
+
+	restarted = NewRemoteProvider(server.URL, options)
+	if _, _, err := restarted.readCache(); err == nil || !strings.Contains(err.Error(), "not signed by a trusted key") {
+		t.Fatalf("Expected tampered cache to be rejected, got %v", err)
+	}
+	if _, err := restarted.readCacheRevision(); err == nil {
+		t.Fatalf("Expected revision of tampered cache to be rejected")
+	}
+}
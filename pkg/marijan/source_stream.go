@@ -0,0 +1,283 @@
+package marijan
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// config stream events, unnamed events carry the full config like `config`
+const (
+	streamEventConfig = "config"
+	streamEventTunnel = "tunnel"
+	streamEventDelete = "delete"
+)
+
+// largest event accepted from config stream
+const maxStreamEventSize = 10 << 20
+
+// reconnect config stream when nothing, not even a heartbeat, is received for this long
+const defaultStreamIdleTimeout = 90 * time.Second
+
+// event that does not change config
+var errSkipEvent = errors.New("config stream event skipped")
+
+// single server-sent event
+type streamEvent struct {
+	name string
+	data string
+	id   string
+}
+
+// read server-sent events until stream ends
+func readEvents(scanner *bufio.Scanner, handle func(streamEvent) error) error {
+	var event streamEvent
+	var data []string
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// blank line dispatches the event
+		if line == "" {
+			if len(data) > 0 {
+				event.data = strings.Join(data, "\n")
+				if err := handle(event); err != nil {
+					return err
+				}
+			}
+			event, data = streamEvent{id: event.id}, nil
+			continue
+		}
+
+		// comment, usually a heartbeat
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+
+		switch field {
+		case "event":
+			event.name = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			event.id = value
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return errors.New("config stream closed by server")
+}
+
+// body of config stream, every read of data pushes idle deadline
+type idleReader struct {
+	reader  io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+// store config pushed by stream, tunnels are replaced by ID and deleted tunnels become inactive
+// tombstones so they are stopped in declarative and non-declarative mode
+func (provider *RemoteProvider) push(full []Config, upserts []Config, deletes []string) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	current := full
+	if current == nil {
+		current = make([]Config, len(provider.current))
+		copy(current, provider.current)
+	}
+
+	set := func(config Config) {
+		for index := range current {
+			if current[index].ID == config.ID {
+				current[index] = config
+				return
+			}
+		}
+		current = append(current, config)
+	}
+
+	for _, config := range upserts {
+		set(config)
+	}
+	for _, id := range deletes {
+		set(Config{ID: id, State: ConfigStateInactive})
+	}
+
+	provider.current = current
+	provider.pushed = true
+}
+
+// apply config stream event to pushed config
+func (provider *RemoteProvider) handleStreamEvent(event streamEvent) error {
+	// incremental events can not be signed, only full signed config is accepted
+	if len(provider.options.TrustedKeys) > 0 && (event.name == streamEventTunnel || event.name == streamEventDelete) {
+		return fmt.Errorf("Rejected %s event, signed config is required", event.name)
+	}
+
+	switch event.name {
+	case "", streamEventConfig:
+		payload, format, err := provider.verifyConfig([]byte(event.data), configFormatJSON, "")
+		if err != nil {
+			return err
+		}
+		document, err := decodeDocument(payload, format, provider.secretPolicy())
+		if err != nil {
+			return fmt.Errorf("Invalid config event: %v", err)
+		}
+		if err := provider.acceptRevision(document.Revision); err != nil {
+			return err
+		}
+		provider.debug(fmt.Sprintf("Received full config from stream with %d tunnels", len(document.Tunnels)))
+
+		// raw event is cached like polled config, a signed envelope keeps its signature
+		if err := provider.writeCache([]byte(event.data), configFormatJSON, "", time.Now()); err != nil {
+			provider.logger().Warn("Error writing remote config cache", zap.Error(err))
+		}
+		provider.push(document.Tunnels, nil, nil)
+	case streamEventTunnel:
+		configs, err := decodeConfigs([]byte("["+event.data+"]"), configFormatJSON, provider.secretPolicy())
+		if err != nil {
+			return fmt.Errorf("Invalid tunnel event: %v", err)
+		}
+		provider.debug(fmt.Sprintf("Received tunnel %s from stream", configs[0].ID))
+		provider.push(nil, configs, nil)
+	case streamEventDelete:
+		var deleted struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal([]byte(event.data), &deleted); err != nil || deleted.ID == "" {
+			return fmt.Errorf("Invalid delete event: id is required")
+		}
+		provider.debug(fmt.Sprintf("Received delete of tunnel %s from stream", deleted.ID))
+		provider.push(nil, nil, []string{deleted.ID})
+	default:
+		provider.debug(fmt.Sprintf("Ignoring unknown config stream event %q", event.name))
+		return errSkipEvent
+	}
+
+	return nil
+}
+
+// Watch holds config stream connection and notifies about pushed config until stream ends,
+// remote config is polled while stream is down
+func (provider *RemoteProvider) Watch(ctx context.Context) (<-chan struct{}, error) {
+	if provider.options.StreamURL == "" {
+		return nil, ErrWatchUnsupported
+	}
+
+	client, err := provider.httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	// stream is long-lived, the connection is bound by context and idle timeout
+	streamClient := *client
+	streamClient.Timeout = 0
+
+	idleTimeout := provider.options.StreamIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultStreamIdleTimeout
+	}
+
+	streamCtx, cancelStream := context.WithCancel(ctx)
+	req, err := provider.newRequest(streamCtx, provider.options.StreamURL)
+	if err != nil {
+		cancelStream()
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if provider.lastEventID != "" {
+		req.Header.Set("Last-Event-ID", provider.lastEventID)
+	}
+
+	resp, err := streamClient.Do(req)
+	if err != nil {
+		cancelStream()
+		return nil, fmt.Errorf("Error connecting to config stream: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancelStream()
+		return nil, fmt.Errorf("Received non-OK HTTP status from config stream: %s", resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/event-stream" {
+		resp.Body.Close()
+		cancelStream()
+		return nil, fmt.Errorf("Config stream returned %q instead of text/event-stream", resp.Header.Get("Content-Type"))
+	}
+
+	// half-open connection never ends the read, stream is cancelled once idle
+	var idle atomic.Bool
+	idleTimer := time.AfterFunc(idleTimeout, func() {
+		idle.Store(true)
+		cancelStream()
+	})
+
+	provider.logger().Info("Connected to config stream", zap.String("url", provider.options.StreamURL))
+
+	changes := make(chan struct{}, 1)
+
+	go func() {
+		defer close(changes)
+		defer cancelStream()
+		defer idleTimer.Stop()
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(idleReader{reader: resp.Body, timer: idleTimer, timeout: idleTimeout})
+		scanner.Buffer(make([]byte, 64*1024), maxStreamEventSize)
+
+		err := readEvents(scanner, func(event streamEvent) error {
+			provider.lastEventID = event.id
+
+			if err := provider.handleStreamEvent(event); err != nil {
+				if !errors.Is(err, errSkipEvent) {
+					// a bad event does not break the stream, following events may fix it
+					provider.logger().Error("Error applying config stream event", zap.Error(err))
+				}
+				return nil
+			}
+
+			select {
+			case changes <- struct{}{}:
+			default:
+				// change already pending
+			}
+			return nil
+		})
+		if idle.Load() {
+			err = fmt.Errorf("no data received for %s", idleTimeout)
+		}
+		if ctx.Err() == nil {
+			provider.logger().Warn("Config stream closed", zap.Error(err))
+		}
+	}()
+
+	return changes, nil
+}
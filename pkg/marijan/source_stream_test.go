@@ -0,0 +1,192 @@
+package marijan
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// wait until check passes or fail after timeout
+func waitFor(t *testing.T, message string, check func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %s", message)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func tunnelJSON(id string) string {
+	return fmt.Sprintf(`{"id": %q, "tunnel_host": "127.0.0.1", "tunnel_port": "1", "listener_host": "localhost", "listener_port": "3001", "service_host": "localhost", "service_port": "3000", "state": "active"}`, id)
+}
+
+func TestStream_Events(t *testing.T) {
+	events := make(chan string, 10)
+	connected := make(chan struct{}, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	})
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		connected <- struct{}{}
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event := <-events:
+				fmt.Fprint(w, event)
+				w.(http.Flusher).Flush()
+			}
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	cache := filepath.Join(t.TempDir(), "remote-cache.json")
+	manager := NewManager(
+		WithSource(ConfigSourceRemote),
+		WithURL(server.URL+"/config"),
+		WithStream(server.URL+"/stream"),
+		WithCache(cache),
+		WithInterval(time.Hour),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- manager.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout waiting for stream to connect")
+	}
+
+	events <- ": heartbeat\n\nevent: config\nid: 1\ndata: [" + tunnelJSON("web") + "]\n\n"
+	waitFor(t, "full config", func() bool {
+		_, ok := manager.GetTunnel("web")
+		return ok
+	})
+
+	// pushed full config is cached like polled config
+	cached, _, err := NewRemoteProvider(server.URL+"/config", RemoteOptions{CacheFile: cache}).readCache()
+	if err != nil || len(cached) != 1 || cached[0].ID != "web" {
+		t.Fatalf("Expected pushed config in cache, got %+v (%v)", cached, err)
+	}
+
+	events <- "event: tunnel\nid: 2\ndata: " + tunnelJSON("api") + "\n\n"
+	waitFor(t, "tunnel upsert", func() bool {
+		_, ok := manager.GetTunnel("api")
+		return ok
+	})
+
+	events <- "event: delete\nid: 3\ndata: {\"id\": \"web\"}\n\n"
+	waitFor(t, "tunnel delete", func() bool {
+		_, ok := manager.GetTunnel("web")
+		return !ok
+	})
+}
+
+func TestStream_FallbackToPolling(t *testing.T) {
+	// tunnel only shows up after the initial load, so it must come from polling
+	var requests atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Write([]byte("[]"))
+			return
+		}
+		w.Write([]byte("[" + tunnelJSON("polled") + "]"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	manager := NewManager(
+		WithSource(ConfigSourceRemote),
+		WithURL(server.URL+"/config"),
+		WithStream(server.URL+"/stream"),
+		WithInterval(50*time.Millisecond),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- manager.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor(t, "polled config", func() bool {
+		_, ok := manager.GetTunnel("polled")
+		return ok
+	})
+}
+
+func TestStream_IdleTimeout(t *testing.T) {
+	heartbeats := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		// heartbeats keep stream alive, afterwards server stops writing without closing
+		if <-heartbeats {
+			for range 10 {
+				fmt.Fprint(w, ": heartbeat\n\n")
+				w.(http.Flusher).Flush()
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	provider := NewRemoteProvider(server.URL+"/config", RemoteOptions{
+		StreamURL:         server.URL + "/stream",
+		StreamIdleTimeout: 200 * time.Millisecond,
+	})
+
+	for _, heartbeat := range []bool{true, false} {
+		heartbeats <- heartbeat
+		started := time.Now()
+
+		changes, err := provider.Watch(context.Background())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		select {
+		case _, ok := <-changes:
+			if ok {
+				t.Fatalf("Expected no change from stream")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout waiting for idle stream to be closed")
+		}
+
+		elapsed := time.Since(started)
+		if heartbeat && elapsed < 500*time.Millisecond {
+			t.Fatalf("Expected heartbeats to keep stream open, closed after %s", elapsed)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package marijan
+
+import (
+	"maps"
+	"time"
+)
+
+// TunnelStatus is runtime status of a tunnel managed by marijan
+type TunnelStatus struct {
+	ID        string     `json:"id"`
+	State     string     `json:"state"`
+	Attempts  int        `json:"attempts"`
+	NextRetry *time.Time `json:"next_retry,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	// layer each effective field came from, such as remote, override or runtime
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// get status of every managed tunnel
+func (manager *Manager) Status() []TunnelStatus {
+	var statuses []TunnelStatus
+
+	manager.mu.RLock()
+	paused := maps.Clone(manager.paused)
+	manager.mu.RUnlock()
+
+	for _, config := range manager.GetCurrentConfigs() {
+		status := TunnelStatus{
+			ID:       config.ID,
+			State:    "Idle",
+			Attempts: config.reconnect.attempts,
+			Fields:   config.origins,
+		}
+
+		if config.connection != nil {
+			status.State = config.connection.GetStateString()
+			if err := config.connection.GetError(); err != nil {
+				status.LastError = err.Error()
+			}
+		}
+		if paused[config.ID] {
+			status.State = "Paused"
+		}
+
+		if status.State != "Connected" && config.reconnect.nextRetry.After(time.Now()) {
+			nextRetry := config.reconnect.nextRetry
+			status.NextRetry = &nextRetry
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
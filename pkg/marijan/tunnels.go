@@ -0,0 +1,180 @@
+package marijan
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrStopping is returned by runtime API once manager started shutting down
+var ErrStopping = errors.New("manager is stopping")
+
+// check if tunnel is managed or added through runtime API, must be called with lock held
+func (manager *Manager) exists(id string) bool {
+	if manager.indexOf(id) >= 0 {
+		return true
+	}
+
+	override, ok := manager.overrides[id]
+
+	return ok && override.State == ConfigStateActive
+}
+
+// AddTunnel adds a tunnel at runtime. It takes precedence over config source until removed,
+// empty state is treated as active.
+func (manager *Manager) AddTunnel(config Config) error {
+	if config.State == "" {
+		config.State = ConfigStateActive
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	manager.mu.Lock()
+	if manager.stopping {
+		manager.mu.Unlock()
+		return ErrStopping
+	}
+	if manager.exists(config.ID) {
+		manager.mu.Unlock()
+		return fmt.Errorf("Tunnel %s already exists", config.ID)
+	}
+	manager.overrides[config.ID] = config
+	manager.mu.Unlock()
+
+	manager.refresh()
+
+	return nil
+}
+
+// UpdateTunnel replaces config of an existing tunnel at runtime, it takes precedence over config source
+func (manager *Manager) UpdateTunnel(config Config) error {
+	if config.State == "" {
+		config.State = ConfigStateActive
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	manager.mu.Lock()
+	if manager.stopping {
+		manager.mu.Unlock()
+		return ErrStopping
+	}
+	if !manager.exists(config.ID) {
+		manager.mu.Unlock()
+		return fmt.Errorf("Tunnel %s not found", config.ID)
+	}
+	manager.overrides[config.ID] = config
+	manager.mu.Unlock()
+
+	manager.refresh()
+
+	return nil
+}
+
+// RemoveTunnel stops and removes a tunnel at runtime, it stays removed even if config source still has it
+func (manager *Manager) RemoveTunnel(id string) error {
+	manager.mu.Lock()
+	if manager.stopping {
+		manager.mu.Unlock()
+		return ErrStopping
+	}
+	if !manager.exists(id) {
+		manager.mu.Unlock()
+		return fmt.Errorf("Tunnel %s not found", id)
+	}
+	manager.overrides[id] = Config{ID: id, State: ConfigStateInactive}
+	manager.mu.Unlock()
+
+	manager.refresh()
+
+	return nil
+}
+
+// GetTunnel gets config of a managed tunnel by ID, secrets are masked like GetCurrentConfigs
+func (manager *Manager) GetTunnel(id string) (Config, bool) {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	index := manager.indexOf(id)
+	if index < 0 {
+		return Config{}, false
+	}
+
+	return manager.configs[index].Masked(), true
+}
+
+// Reconnect closes connection of a tunnel and connects it again right away, backoff is reset
+func (manager *Manager) Reconnect(id string) error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if manager.stopping {
+		return ErrStopping
+	}
+
+	index := manager.indexOf(id)
+	if index < 0 {
+		return fmt.Errorf("Tunnel %s not found", id)
+	}
+	if manager.paused[id] {
+		return fmt.Errorf("Tunnel %s is paused", id)
+	}
+
+	manager.logger().Info(fmt.Sprintf("Connection ID %s reconnect requested", id))
+	manager.configs[index].reconnect = reconnectState{}
+	if !manager.running() {
+		return nil
+	}
+
+	return manager.connect(index)
+}
+
+// Pause closes connection of a tunnel and keeps it closed, also across config reloads, until Resume
+func (manager *Manager) Pause(id string) error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if manager.stopping {
+		return ErrStopping
+	}
+
+	index := manager.indexOf(id)
+	if index < 0 {
+		return fmt.Errorf("Tunnel %s not found", id)
+	}
+
+	manager.logger().Info(fmt.Sprintf("Connection ID %s paused", id))
+	manager.paused[id] = true
+	manager.maintainConnection(index, time.Now())
+
+	return nil
+}
+
+// Resume connects a tunnel paused by Pause right away
+func (manager *Manager) Resume(id string) error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if manager.stopping {
+		return ErrStopping
+	}
+
+	index := manager.indexOf(id)
+	if index < 0 {
+		return fmt.Errorf("Tunnel %s not found", id)
+	}
+	if !manager.paused[id] {
+		return nil
+	}
+
+	manager.logger().Info(fmt.Sprintf("Connection ID %s resumed", id))
+	delete(manager.paused, id)
+	manager.configs[index].reconnect = reconnectState{}
+	if manager.running() {
+		manager.maintainConnection(index, time.Now())
+	}
+
+	return nil
+}
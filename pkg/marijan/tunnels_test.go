@@ -0,0 +1,182 @@
+package marijan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devetek/tuman/pkg/tukiran"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	return file
+}
+
+// tunnel config pointing to a closed port, connections fail fast
+func testTunnel(id string) Config {
+	return Config{
+		ID:           id,
+		TunnelHost:   "127.0.0.1",
+		TunnelPort:   "1",
+		ListenerHost: "localhost",
+		ListenerPort: "3001",
+		ServiceHost:  "localhost",
+		ServicePort:  "3000",
+		State:        ConfigStateActive,
+	}
+}
+
+func TestRuntimeAPI_AddUpdateRemove(t *testing.T) {
+	manager := NewManager(
+		WithSource(ConfigSourceFile),
+		WithURL(writeConfigFile(t, `[]`)),
+		WithInterval(10*time.Millisecond),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- manager.Run(ctx)
+	}()
+
+	if err := manager.AddTunnel(testTunnel("api")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := manager.AddTunnel(testTunnel("api")); err == nil {
+		t.Fatalf("Expected error adding duplicate tunnel")
+	}
+
+	updated := testTunnel("api")
+	updated.ServicePort = "4000"
+	if err := manager.UpdateTunnel(updated); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// runtime tunnels survive config reloads
+	time.Sleep(50 * time.Millisecond)
+
+	config, ok := manager.GetTunnel("api")
+	if !ok || config.ServicePort != "4000" {
+		t.Fatalf("Expected updated tunnel, got %+v (found %v)", config, ok)
+	}
+
+	if err := manager.RemoveTunnel("api"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := manager.GetTunnel("api"); ok {
+		t.Fatalf("Expected tunnel to be removed")
+	}
+	if err := manager.UpdateTunnel(updated); err == nil {
+		t.Fatalf("Expected error updating removed tunnel")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestRuntimeAPI_Concurrent(t *testing.T) {
+	manager := NewManager(
+		WithSource(ConfigSourceFile),
+		WithURL(writeConfigFile(t, `[]`)),
+		WithInterval(time.Millisecond),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- manager.Run(ctx)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			id := fmt.Sprintf("tunnel-%d", i)
+			manager.AddTunnel(testTunnel(id))
+			manager.GetTunnel(id)
+			manager.GetCurrentConfigs()
+			manager.Status()
+			manager.RemoveTunnel(id)
+		}()
+	}
+	wg.Wait()
+
+	cancel()
+	<-done
+
+	if configs := manager.GetCurrentConfigs(); len(configs) != 0 {
+		t.Fatalf("Expected no tunnels left, got %d", len(configs))
+	}
+}
+
+func TestRuntimeAPI_RefusedWhileDraining(t *testing.T) {
+	config := forwardedTunnel(t, "web", startDelayedTunnelServer(t, 0))
+	manager := NewManager(WithProvider(staticProvider{config}), WithInterval(time.Hour), WithDrainTimeout(5*time.Second))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- manager.Run(ctx)
+	}()
+
+	var connection *tukiran.TunnelForwarder
+	waitFor(t, "connection to connect", func() bool {
+		current, _ := manager.GetTunnel("web")
+		connection = current.connection
+		return connection != nil && connection.GetState() == tukiran.Connected
+	})
+
+	// in-flight connection keeps drain waiting
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+config.ListenerPort, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial tunnel: %v", err)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+
+	cancel()
+	waitFor(t, "manager to stop", func() bool {
+		manager.mu.RLock()
+		defer manager.mu.RUnlock()
+		return manager.stopping
+	})
+
+	if err := manager.Reconnect("web"); !errors.Is(err, ErrStopping) {
+		t.Fatalf("Expected reconnect to be refused, got %v", err)
+	}
+	if err := manager.AddTunnel(testTunnel("api")); !errors.Is(err, ErrStopping) {
+		t.Fatalf("Expected add to be refused, got %v", err)
+	}
+	if current, _ := manager.GetTunnel("web"); current.connection != connection {
+		t.Fatalf("Expected no new connection while draining")
+	}
+
+	conn.Close()
+	if err := <-result; err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package marijan
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// check port is a number between 1 and 65535
+func validPort(port string) bool {
+	number, err := strconv.Atoi(port)
+	return err == nil && number >= 1 && number <= 65535
+}
+
+// Validate checks required fields and value ranges of tunnel config, every problem is reported
+func (config Config) Validate() error {
+	var errs []error
+
+	// values resolved from environment or files are not shown
+	shown := func(field string, value string) string {
+		if config.isSecret(field) {
+			return secretMask
+		}
+		return value
+	}
+	required := func(field string, value string) {
+		if strings.TrimSpace(value) == "" {
+			errs = append(errs, fmt.Errorf("%s: is required", field))
+		}
+	}
+	port := func(field string, value string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s: is required", field))
+		} else if !validPort(value) {
+			errs = append(errs, fmt.Errorf("%s: must be a number between 1 and 65535, got %q", field, shown(field, value)))
+		}
+	}
+
+	required("id", config.ID)
+
+	if config.State != ConfigStateActive && config.State != ConfigStateInactive {
+		errs = append(errs, fmt.Errorf("state: must be %q or %q, got %q", ConfigStateActive, ConfigStateInactive, shown("state", string(config.State))))
+	}
+
+	// inactive tunnel is only referenced by its ID
+	if config.State == ConfigStateInactive {
+		return errors.Join(errs...)
+	}
+
+	required("tunnel_host", config.TunnelHost)
+	port("tunnel_port", config.TunnelPort)
+	required("listener_host", config.ListenerHost)
+	// unix socket listener uses listener_host as directory
+	if !config.NoTCP && !strings.HasPrefix(config.ListenerHost, "/") {
+		port("listener_port", config.ListenerPort)
+	}
+	required("service_host", config.ServiceHost)
+	port("service_port", config.ServicePort)
+
+	switch config.HostKey.Policy {
+	case "", HostKeyPolicyInsecure, HostKeyPolicyKnownHosts, HostKeyPolicyTOFU:
+	case HostKeyPolicyFingerprint:
+		if len(config.HostKey.Fingerprints) == 0 {
+			errs = append(errs, errors.New("host_key.fingerprints: is required by fingerprint policy"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("host_key.policy: unknown policy %q", shown("host_key.policy", string(config.HostKey.Policy))))
+	}
+
+	if config.Auth.CertificateFile != "" && config.Auth.PrivateKeyFile == "" && config.Auth.PrivateKey == "" {
+		errs = append(errs, errors.New("auth.certificate_file: requires private_key_file or private_key"))
+	}
+
+	if config.KeepaliveMaxMissed < 0 {
+		errs = append(errs, errors.New("keepalive_max_missed: must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// treat tunnels without state as inactive, like before state was validated they are not started
+func defaultStates(configs []Config) {
+	for index := range configs {
+		if configs[index].State == "" {
+			configs[index].State = ConfigStateInactive
+		}
+	}
+}
+
+// validate every tunnel config and check IDs are unique
+func validateConfigs(configs []Config) error {
+	var errs []error
+	seen := make(map[string]int, len(configs))
+
+	for index, config := range configs {
+		name := fmt.Sprintf("tunnel[%d]", index)
+		if config.ID != "" {
+			name = fmt.Sprintf("tunnel[%d] (id %q)", index, config.ID)
+		}
+
+		if err := config.Validate(); err != nil {
+			for _, fieldErr := range unwrapErrors(err) {
+				errs = append(errs, fmt.Errorf("%s: %v", name, fieldErr))
+			}
+		}
+
+		if first, ok := seen[config.ID]; ok && config.ID != "" {
+			errs = append(errs, fmt.Errorf("%s: duplicate id, already used by tunnel[%d]", name, first))
+		} else {
+			seen[config.ID] = index
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// check tunnels have unique ID, used for partial configs validated after merging
+func validateIDs(configs []Config) error {
+	var errs []error
+	seen := make(map[string]int, len(configs))
+
+	for index, config := range configs {
+		if config.ID == "" {
+			errs = append(errs, fmt.Errorf("tunnel[%d]: id: is required", index))
+			continue
+		}
+		if first, ok := seen[config.ID]; ok {
+			errs = append(errs, fmt.Errorf("tunnel[%d] (id %q): duplicate id, already used by tunnel[%d]", index, config.ID, first))
+			continue
+		}
+		seen[config.ID] = index
+	}
+
+	return errors.Join(errs...)
+}
+
+// get errors joined by errors.Join
+func unwrapErrors(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+
+	return []error{err}
+}
@@ -0,0 +1,103 @@
+package tukiran
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// AgentAuth provides signers from a running ssh-agent. The agent socket is kept open
+// while the SSH handshake is in progress and closed by TunnelForwarder once dial is done.
+type AgentAuth struct {
+	socket   string
+	identity string
+	mu       sync.Mutex
+	conn     net.Conn
+}
+
+// create ssh-agent auth, empty socket uses SSH_AUTH_SOCK and empty identity uses every key in the agent
+func NewAgentAuth(socket string, identity string) *AgentAuth {
+	return &AgentAuth{
+		socket:   socket,
+		identity: identity,
+	}
+}
+
+// get agent socket path
+func (a *AgentAuth) getSocket() string {
+	if a.socket != "" {
+		return a.socket
+	}
+
+	return os.Getenv("SSH_AUTH_SOCK")
+}
+
+// check if agent key matches identity by comment or SHA256 fingerprint
+func (a *AgentAuth) match(key ssh.PublicKey) bool {
+	if a.identity == "" {
+		return true
+	}
+
+	if agentKey, ok := key.(*agent.Key); ok && agentKey.Comment == a.identity {
+		return true
+	}
+
+	return ssh.FingerprintSHA256(key) == normalizeFingerprint(a.identity)
+}
+
+// get signers from the agent, filtered by identity
+func (a *AgentAuth) Signers() ([]ssh.Signer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.conn == nil {
+		socket := a.getSocket()
+		if socket == "" {
+			return nil, errors.New("SSH_AUTH_SOCK is not set and no agent socket configured")
+		}
+
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to ssh-agent: %v", err)
+		}
+		a.conn = conn
+	}
+
+	signers, err := agent.NewClient(a.conn).Signers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ssh-agent keys: %v", err)
+	}
+
+	var matched []ssh.Signer
+	for _, signer := range signers {
+		if a.match(signer.PublicKey()) {
+			matched = append(matched, signer)
+		}
+	}
+
+	if len(matched) == 0 && a.identity != "" {
+		return nil, fmt.Errorf("no key in ssh-agent matches identity %s", a.identity)
+	}
+
+	return matched, nil
+}
+
+// close agent socket
+func (a *AgentAuth) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.conn == nil {
+		return nil
+	}
+
+	err := a.conn.Close()
+	a.conn = nil
+
+	return err
+}
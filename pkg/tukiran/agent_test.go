@@ -0,0 +1,77 @@
+package tukiran
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func startTestAgent(t *testing.T, comments ...string) string {
+	t.Helper()
+
+	keyring := agent.NewKeyring()
+	for _, comment := range comments {
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+		if err := keyring.Add(agent.AddedKey{PrivateKey: privateKey, Comment: comment}); err != nil {
+			t.Fatalf("Failed to add key: %v", err)
+		}
+	}
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen agent socket: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+
+	return socket
+}
+
+func TestAgentAuth_FilterByComment(t *testing.T) {
+	socket := startTestAgent(t, "deploy@ci", "ops@laptop")
+
+	agentAuth := NewAgentAuth(socket, "ops@laptop")
+	defer agentAuth.Close()
+
+	signers, err := agentAuth.Signers()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(signers) != 1 {
+		t.Fatalf("Expected 1 signer, got %d", len(signers))
+	}
+
+	fingerprint := ssh.FingerprintSHA256(signers[0].PublicKey())
+	byFingerprint := NewAgentAuth(socket, fingerprint)
+	defer byFingerprint.Close()
+
+	signers, err = byFingerprint.Signers()
+	if err != nil || len(signers) != 1 {
+		t.Fatalf("Expected 1 signer by fingerprint, got %d (%v)", len(signers), err)
+	}
+
+	missing := NewAgentAuth(socket, "unknown")
+	defer missing.Close()
+
+	if _, err := missing.Signers(); err == nil {
+		t.Fatalf("Expected error for unknown identity")
+	}
+}
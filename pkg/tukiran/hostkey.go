@@ -0,0 +1,307 @@
+package tukiran
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyError is returned when the tunnel server host key fails verification.
+// It is permanent, reconnecting to the same server will fail the same way.
+type HostKeyError struct {
+	Hostname    string
+	Fingerprint string
+	Reason      string
+}
+
+func (e *HostKeyError) Error() string {
+	return fmt.Sprintf("host key verification failed for %s (%s): %s", e.Hostname, e.Fingerprint, e.Reason)
+}
+
+// serialize known_hosts writes across tunnels sharing the same file
+var knownHostsMu sync.Mutex
+
+// normalize fingerprint to the format returned by ssh.FingerprintSHA256
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.TrimSpace(fingerprint)
+	fingerprint = strings.TrimPrefix(fingerprint, "SHA256:")
+	fingerprint = strings.TrimRight(fingerprint, "=")
+
+	return "SHA256:" + fingerprint
+}
+
+// convert knownhosts errors to HostKeyError, keep other errors untouched
+func knownHostsError(hostname string, key ssh.PublicKey, err error) error {
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) {
+		reason := "host is not in known_hosts"
+		if len(keyErr.Want) > 0 {
+			reason = "host key mismatch with known_hosts"
+		}
+		return &HostKeyError{Hostname: hostname, Fingerprint: ssh.FingerprintSHA256(key), Reason: reason}
+	}
+
+	var revokedErr *knownhosts.RevokedError
+	if errors.As(err, &revokedErr) {
+		return &HostKeyError{Hostname: hostname, Fingerprint: ssh.FingerprintSHA256(key), Reason: "host key is revoked"}
+	}
+
+	// host certificate rejected by ssh.CertChecker, e.g. unknown authority, wrong principal or expired
+	if cert, ok := key.(*ssh.Certificate); ok && err != nil {
+		reason := fmt.Sprintf("host certificate rejected: %s", strings.TrimPrefix(err.Error(), "ssh: "))
+		return &HostKeyError{Hostname: hostname, Fingerprint: ssh.FingerprintSHA256(cert.Key), Reason: reason}
+	}
+
+	return err
+}
+
+// verify tunnel server against OpenSSH known_hosts files
+func KnownHostsCallback(files ...string) (ssh.HostKeyCallback, error) {
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return knownHostsError(hostname, key, callback(hostname, remote, key))
+	}, nil
+}
+
+// verify tunnel server against pinned SHA256 fingerprints
+func FingerprintCallback(fingerprints ...string) ssh.HostKeyCallback {
+	pinned := make(map[string]bool, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		pinned[normalizeFingerprint(fingerprint)] = true
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		if !pinned[fingerprint] {
+			return &HostKeyError{Hostname: hostname, Fingerprint: fingerprint, Reason: "fingerprint is not pinned"}
+		}
+		return nil
+	}
+}
+
+// trust tunnel server on first use, the first seen host key is written to file and verified afterwards
+func TOFUCallback(file string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		knownHostsMu.Lock()
+		defer knownHostsMu.Unlock()
+
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		callback, err := knownhosts.New(file)
+		if err != nil {
+			return err
+		}
+
+		err = callback(hostname, remote, key)
+
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			// first time seeing this host, trust and remember it
+			line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+			if _, err := f.WriteString(line + "\n"); err != nil {
+				return err
+			}
+			return nil
+		}
+
+		return knownHostsError(hostname, key, err)
+	}
+}
+
+// plain host key algorithms in the order x/crypto prefers them, without certificates
+var plainHostKeyAlgorithms = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA,
+}
+
+// host certificate algorithms, offered when a @cert-authority line matches the host
+var certHostKeyAlgorithms = []string{
+	ssh.CertAlgoED25519v01,
+	ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+	ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01,
+}
+
+// get signature algorithms of a known host key type
+func keyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+
+	return []string{keyType}
+}
+
+// check if known_hosts host pattern list matches normalized host, negated patterns win
+func matchHosts(patterns string, host string) bool {
+	matched := false
+
+	for _, pattern := range strings.Split(patterns, ",") {
+		if hashed, ok := strings.CutPrefix(pattern, "|1|"); ok {
+			salt, hash, _ := strings.Cut(hashed, "|")
+			saltBytes, saltErr := base64.StdEncoding.DecodeString(salt)
+			hashBytes, hashErr := base64.StdEncoding.DecodeString(hash)
+			if saltErr == nil && hashErr == nil {
+				mac := hmac.New(sha1.New, saltBytes)
+				mac.Write([]byte(host))
+				matched = matched || hmac.Equal(mac.Sum(nil), hashBytes)
+			}
+			continue
+		}
+
+		negated := strings.HasPrefix(pattern, "!")
+		if matchWildcard(strings.TrimPrefix(pattern, "!"), host) {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+// match OpenSSH wildcard pattern with `*` and `?`
+func matchWildcard(pattern string, value string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for index := len(value); index >= 0; index-- {
+				if matchWildcard(pattern[1:], value[index:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(value) == 0 {
+				return false
+			}
+		default:
+			if len(value) == 0 || pattern[0] != value[0] {
+				return false
+			}
+		}
+		pattern, value = pattern[1:], value[1:]
+	}
+
+	return len(value) == 0
+}
+
+// check if a @cert-authority line of known_hosts files matches address
+func hasCertAuthority(address string, files ...string) (bool, error) {
+	host := knownhosts.Normalize(address)
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "@cert-authority" && matchHosts(fields[1], host) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// KnownHostsAlgorithms gets host key algorithms of known_hosts entries for address, so the
+// server presents a key type that is known like OpenSSH does. Certificate algorithms come first
+// when a @cert-authority line matches. Nil is returned for unknown hosts, default algorithms are used then.
+func KnownHostsAlgorithms(address string, files ...string) ([]string, error) {
+	var existing []string
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			existing = append(existing, file)
+		}
+	}
+	if len(existing) == 0 {
+		return nil, nil
+	}
+
+	callback, err := knownhosts.New(existing...)
+	if err != nil {
+		return nil, err
+	}
+
+	var algorithms []string
+	seen := map[string]bool{}
+	add := func(list ...string) {
+		for _, algorithm := range list {
+			if !seen[algorithm] {
+				seen[algorithm] = true
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+	}
+
+	certAuthority, err := hasCertAuthority(address, existing...)
+	if err != nil {
+		return nil, err
+	}
+	if certAuthority {
+		add(certHostKeyAlgorithms...)
+	}
+
+	// a throwaway key never matches, the error lists every known key of the host
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	probe, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyErr *knownhosts.KeyError
+	if err := callback(address, &net.TCPAddr{}, probe); errors.As(err, &keyErr) {
+		for _, known := range keyErr.Want {
+			add(keyAlgorithms(known.Key.Type())...)
+		}
+	}
+
+	return algorithms, nil
+}
+
+// TOFUAlgorithms gets host key algorithms for trust-on-first-use file. A known host keeps its
+// remembered key type, an unknown host is asked for a plain key since certificates can not be pinned.
+func TOFUAlgorithms(address string, file string) ([]string, error) {
+	algorithms, err := KnownHostsAlgorithms(address, file)
+	if err != nil || len(algorithms) > 0 {
+		return algorithms, err
+	}
+
+	return plainHostKeyAlgorithms, nil
+}
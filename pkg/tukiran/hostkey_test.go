@@ -0,0 +1,321 @@
+package tukiran
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	gliderssh "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func generateHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	key, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("Failed to convert key: %v", err)
+	}
+
+	return key
+}
+
+func TestTOFUCallback_TrustFirstKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "marijan", "known_hosts")
+	remote := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2220}
+	callback := TOFUCallback(file)
+
+	key := generateHostKey(t)
+	if err := callback("127.0.0.1:2220", remote, key); err != nil {
+		t.Fatalf("Expected first key to be trusted, got %v", err)
+	}
+	if err := callback("127.0.0.1:2220", remote, key); err != nil {
+		t.Fatalf("Expected known key to be accepted, got %v", err)
+	}
+
+	var hostKeyErr *HostKeyError
+	err := callback("127.0.0.1:2220", remote, generateHostKey(t))
+	if !errors.As(err, &hostKeyErr) {
+		t.Fatalf("Expected HostKeyError for changed key, got %v", err)
+	}
+}
+
+func TestFingerprintCallback_Pinned(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2220}
+	key := generateHostKey(t)
+	callback := FingerprintCallback(ssh.FingerprintSHA256(key))
+
+	if err := callback("127.0.0.1:2220", remote, key); err != nil {
+		t.Fatalf("Expected pinned key to be accepted, got %v", err)
+	}
+
+	var hostKeyErr *HostKeyError
+	err := callback("127.0.0.1:2220", remote, generateHostKey(t))
+	if !errors.As(err, &hostKeyErr) {
+		t.Fatalf("Expected HostKeyError for unpinned key, got %v", err)
+	}
+}
+
+// generate a new ed25519 signer
+func generateSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+
+	return signer
+}
+
+// create host certificate for principal signed by authority, returns signer presenting it
+func signHostCertificate(t *testing.T, authority ssh.Signer, principal string) ssh.Signer {
+	t.Helper()
+
+	hostKey := generateSigner(t)
+	cert := &ssh.Certificate{
+		Key:             hostKey.PublicKey(),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{principal},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, authority); err != nil {
+		t.Fatalf("Failed to sign host certificate: %v", err)
+	}
+
+	signer, err := ssh.NewCertSigner(cert, hostKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate signer: %v", err)
+	}
+
+	return signer
+}
+
+// write known_hosts file trusting authority for address
+func writeCertAuthority(t *testing.T, address string, authority ssh.PublicKey) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	line := "@cert-authority " + knownhosts.Line([]string{knownhosts.Normalize(address)}, authority) + "\n"
+	if err := os.WriteFile(file, []byte(line), 0600); err != nil {
+		t.Fatalf("Failed to write known_hosts: %v", err)
+	}
+
+	return file
+}
+
+func TestKnownHostsCallback_CertAuthority(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2220}
+	authority := generateSigner(t)
+	callback, err := KnownHostsCallback(writeCertAuthority(t, "127.0.0.1:2220", authority.PublicKey()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	signed := signHostCertificate(t, authority, "127.0.0.1")
+	if err := callback("127.0.0.1:2220", remote, signed.PublicKey()); err != nil {
+		t.Fatalf("Expected certificate signed by trusted authority to be accepted, got %v", err)
+	}
+
+	var hostKeyErr *HostKeyError
+	untrusted := signHostCertificate(t, generateSigner(t), "127.0.0.1")
+	if err := callback("127.0.0.1:2220", remote, untrusted.PublicKey()); !errors.As(err, &hostKeyErr) {
+		t.Fatalf("Expected HostKeyError for certificate of unknown authority, got %v", err)
+	}
+
+	otherHost := signHostCertificate(t, authority, "example.com")
+	if err := callback("127.0.0.1:2220", remote, otherHost.PublicKey()); !errors.As(err, &hostKeyErr) {
+		t.Fatalf("Expected HostKeyError for certificate of another host, got %v", err)
+	}
+}
+
+func TestListenAndServe_HostCertificateWrongAuthority(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := &gliderssh.Server{HostSigners: []gliderssh.Signer{signHostCertificate(t, generateSigner(t), "127.0.0.1")}}
+	go server.Serve(listener)
+	defer server.Close()
+
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	callback, err := KnownHostsCallback(writeCertAuthority(t, "127.0.0.1:"+port, generateSigner(t).PublicKey()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tf := NewTunnelRemoteForwarder(
+		WithTunnelHost("127.0.0.1"),
+		WithTunnelPort(port),
+		WithTunnelAuthMethod(&ssh.ClientConfig{HostKeyCallback: callback}),
+		WithDialTimeout(5*time.Second),
+	)
+
+	if err := tf.ListenAndServe(context.Background()); err == nil {
+		t.Fatalf("Expected host certificate to be rejected")
+	}
+	if tf.IsRetryable() {
+		t.Fatalf("Expected rejected host certificate to be permanent, got %v", tf.GetError())
+	}
+}
+
+// generate a new ecdsa signer
+func generateECDSASigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+
+	return signer
+}
+
+// serve ssh server with host signers, returns its address
+func startHostKeyServer(t *testing.T, signers ...gliderssh.Signer) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := &gliderssh.Server{HostSigners: signers}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	return listener.Addr().String()
+}
+
+// dial ssh server and return handshake error
+func dialHostKey(address string, callback ssh.HostKeyCallback, algorithms []string) error {
+	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		HostKeyCallback:   callback,
+		HostKeyAlgorithms: algorithms,
+		Timeout:           5 * time.Second,
+	})
+	if err != nil {
+		return err
+	}
+
+	return client.Close()
+}
+
+func TestKnownHostsAlgorithms_ServerWithTwoHostKeys(t *testing.T) {
+	ed25519Key := generateSigner(t)
+	address := startHostKeyServer(t, generateECDSASigner(t), ed25519Key)
+
+	// known_hosts only has the ed25519 key, like most hosts added with ssh-keyscan -t ed25519
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(address)}, ed25519Key.PublicKey()) + "\n"
+	if err := os.WriteFile(file, []byte(line), 0600); err != nil {
+		t.Fatalf("Failed to write known_hosts: %v", err)
+	}
+
+	callback, err := KnownHostsCallback(file)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// default algorithms negotiate ecdsa first
+	var hostKeyErr *HostKeyError
+	if err := dialHostKey(address, callback, nil); !errors.As(err, &hostKeyErr) {
+		t.Fatalf("Expected ecdsa host key to be rejected with default algorithms, got %v", err)
+	}
+
+	algorithms, err := KnownHostsAlgorithms(address, file)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(algorithms) != 1 || algorithms[0] != ssh.KeyAlgoED25519 {
+		t.Fatalf("Expected only ed25519 algorithm, got %v", algorithms)
+	}
+	if err := dialHostKey(address, callback, algorithms); err != nil {
+		t.Fatalf("Expected known ed25519 host key to be accepted, got %v", err)
+	}
+
+	// unknown host keeps default algorithms
+	if algorithms, err := KnownHostsAlgorithms("127.0.0.1:1", file); err != nil || algorithms != nil {
+		t.Fatalf("Expected no algorithms for unknown host, got %v (%v)", algorithms, err)
+	}
+}
+
+func TestKnownHostsAlgorithms_CertAuthority(t *testing.T) {
+	authority := generateSigner(t)
+	file := writeCertAuthority(t, "127.0.0.1:2220", authority.PublicKey())
+
+	algorithms, err := KnownHostsAlgorithms("127.0.0.1:2220", file)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(algorithms) == 0 || algorithms[0] != ssh.CertAlgoED25519v01 {
+		t.Fatalf("Expected certificate algorithms first, got %v", algorithms)
+	}
+
+	if algorithms, _ := KnownHostsAlgorithms("127.0.0.1:2221", file); algorithms != nil {
+		t.Fatalf("Expected authority of another port not to match, got %v", algorithms)
+	}
+}
+
+func TestTOFUAlgorithms_HostCertificate(t *testing.T) {
+	authority := generateSigner(t)
+	hostKey := generateSigner(t)
+	cert := &ssh.Certificate{
+		Key:             hostKey.PublicKey(),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"127.0.0.1"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, authority); err != nil {
+		t.Fatalf("Failed to sign host certificate: %v", err)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, hostKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate signer: %v", err)
+	}
+
+	// server presents a host certificate next to its plain key and an ecdsa key
+	address := startHostKeyServer(t, certSigner, hostKey, generateECDSASigner(t))
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	callback := TOFUCallback(file)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		algorithms, err := TOFUAlgorithms(address, file)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := dialHostKey(address, callback, algorithms); err != nil {
+			t.Fatalf("Expected attempt %d to be trusted, got %v", attempt+1, err)
+		}
+	}
+
+	// the pinned key type is asked for on later connections
+	algorithms, _ := TOFUAlgorithms(address, file)
+	if len(algorithms) != 1 {
+		t.Fatalf("Expected pinned algorithm, got %v", algorithms)
+	}
+}
@@ -0,0 +1,48 @@
+package tukiran
+
+import (
+	"io"
+	"time"
+)
+
+// Observer receives events of a forwarder, such as to collect metrics. Methods are called
+// from the accept loop and copy goroutines, they must be safe for concurrent use and not block.
+type Observer interface {
+	// SSH handshake with tunnel server finished, err is nil on success
+	Dialed(id string, duration time.Duration, err error)
+	// remote connection accepted and proxied to local service
+	ConnectionAccepted(id string)
+	// proxied connection closed
+	ConnectionClosed(id string)
+	// local service could not be dialed for an accepted connection
+	ServiceDialFailed(id string)
+	// bytes copied from remote connection to local service
+	BytesIn(id string, n int)
+	// bytes copied from local service to remote connection
+	BytesOut(id string, n int)
+}
+
+// observer used when none is set
+type nopObserver struct{}
+
+func (nopObserver) Dialed(string, time.Duration, error) {}
+func (nopObserver) ConnectionAccepted(string)           {}
+func (nopObserver) ConnectionClosed(string)             {}
+func (nopObserver) ServiceDialFailed(string)            {}
+func (nopObserver) BytesIn(string, int)                 {}
+func (nopObserver) BytesOut(string, int)                {}
+
+// writer reporting every write, counts are updated while connection is still open
+type countingWriter struct {
+	writer io.Writer
+	count  func(n int)
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	if n > 0 {
+		w.count(n)
+	}
+
+	return n, err
+}
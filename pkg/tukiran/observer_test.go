@@ -0,0 +1,173 @@
+package tukiran
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// events recorded by observer
+type observedEvents struct {
+	dials         int
+	accepted      int
+	closed        int
+	serviceFailed int
+	bytesIn       int
+	bytesOut      int
+}
+
+// observer recording events for tests
+type recordingObserver struct {
+	mu     sync.Mutex
+	events observedEvents
+}
+
+func (o *recordingObserver) Dialed(id string, duration time.Duration, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events.dials++
+}
+
+func (o *recordingObserver) ConnectionAccepted(id string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events.accepted++
+}
+
+func (o *recordingObserver) ConnectionClosed(id string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events.closed++
+}
+
+func (o *recordingObserver) ServiceDialFailed(id string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events.serviceFailed++
+}
+
+func (o *recordingObserver) BytesIn(id string, n int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events.bytesIn += n
+}
+
+func (o *recordingObserver) BytesOut(id string, n int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events.bytesOut += n
+}
+
+func (o *recordingObserver) snapshot() observedEvents {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.events
+}
+
+func TestObserver_ConnectionEvents(t *testing.T) {
+	observer := &recordingObserver{}
+	listenerPort := freePort(t)
+	tf := NewTunnelRemoteForwarder(
+		WithConnectionID("test"),
+		WithObserver(observer),
+		WithTunnelHost("127.0.0.1"),
+		WithTunnelPort(startTestTunnelServer(t)),
+		WithTunnelAuthMethod(&ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()}),
+		WithListenerHost("127.0.0.1"),
+		WithListenerPort(listenerPort),
+		WithServiceHost("127.0.0.1"),
+		WithServicePort(startTestEchoService(t)),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- tf.ListenAndServe(ctx)
+	}()
+	waitForListener(t, tf)
+
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+listenerPort, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial tunnel listener: %v", err)
+	}
+	conn.Write([]byte("ping"))
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatalf("Failed to read echo reply: %v", err)
+	}
+
+	// counts are reported while connection is still open
+	events := observer.snapshot()
+	if events.dials != 1 || events.accepted != 1 || events.closed != 0 {
+		t.Fatalf("Expected 1 dial, 1 accepted and 0 closed, got %+v", events)
+	}
+	if events.bytesIn != 4 || events.bytesOut != 4 {
+		t.Fatalf("Expected 4 bytes in and out, got %d in and %d out", events.bytesIn, events.bytesOut)
+	}
+
+	conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for observer.snapshot().closed != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for connection closed event")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	<-result
+}
+
+func TestObserver_ServiceDialFailed(t *testing.T) {
+	observer := &recordingObserver{}
+	listenerPort := freePort(t)
+	tf := NewTunnelRemoteForwarder(
+		WithConnectionID("test"),
+		WithObserver(observer),
+		WithTunnelHost("127.0.0.1"),
+		WithTunnelPort(startTestTunnelServer(t)),
+		WithTunnelAuthMethod(&ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()}),
+		WithListenerHost("127.0.0.1"),
+		WithListenerPort(listenerPort),
+		WithServiceHost("127.0.0.1"),
+		WithServicePort(freePort(t)),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- tf.ListenAndServe(ctx)
+	}()
+	waitForListener(t, tf)
+
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+listenerPort, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial tunnel listener: %v", err)
+	}
+	defer conn.Close()
+
+	// remote connection is closed once service dial failed
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.ReadAll(conn)
+
+	if events := observer.snapshot(); events.serviceFailed != 1 {
+		t.Fatalf("Expected 1 service dial failure, got %d", events.serviceFailed)
+	}
+
+	// failed service dial only drops that connection, the tunnel stays up
+	if state := tf.GetState(); state != Connected {
+		t.Fatalf("Expected tunnel to stay connected, got %s", tf.GetStateString())
+	}
+
+	cancel()
+	<-result
+}
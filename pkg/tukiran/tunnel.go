@@ -8,23 +8,35 @@ Copyright (c) 2025 Devetek. All rights reserved.
 */
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 )
 
 type tunnel struct {
-	host string
-	port string
-	auth *ssh.ClientConfig
+	host  string
+	port  string
+	auth  *ssh.ClientConfig
+	agent *AgentAuth
+	// keepalive@openssh.com interval, disabled when zero
+	keepaliveInterval  time.Duration
+	keepaliveMaxMissed int
+	// timeout of tcp dial and ssh handshake, defaultDialTimeout when zero
+	dialTimeout time.Duration
 }
 
+// timeout of tcp dial and ssh handshake when not set
+const defaultDialTimeout = 30 * time.Second
+
 type tcp struct {
 	host string
 	port string
@@ -47,8 +59,22 @@ type TunnelForwarder struct {
 	listener  *tcp
 	service   *tcp
 	zap       *zap.Logger
+	events    Observer
 	sshClient *ssh.Client
+	mu        sync.RWMutex
 	state     ConnectionState
+	lastErr   error
+	// cancel lifetime of ListenAndServe, closed forwarder is never started again
+	cancel context.CancelFunc
+	closed bool
+	// remote listener, closed to stop accepting when draining
+	remoteListener net.Listener
+	draining       bool
+	// active proxied connections and their goroutines
+	conns    map[net.Conn]struct{}
+	active   int
+	stopping bool
+	wg       sync.WaitGroup
 }
 
 func NewTunnelRemoteForwarder(opts ...TunnelForwarderOpt) *TunnelForwarder {
@@ -74,19 +100,56 @@ func (tf *TunnelForwarder) logger() *zap.Logger {
 	return tf.zap.With(zap.Dict("module", zap.String("name", "tukiran")))
 }
 
+func (tf *TunnelForwarder) observer() Observer {
+	if tf.events == nil {
+		return nopObserver{}
+	}
+
+	return tf.events
+}
+
 // set connection state
 func (tf *TunnelForwarder) setState(state int) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
 	tf.state = ConnectionState(state)
 }
 
+// set error state and remember the cause
+func (tf *TunnelForwarder) setError(err error) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	tf.state = Error
+	tf.lastErr = err
+}
+
 // get connection state
 func (tf *TunnelForwarder) GetState() ConnectionState {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+
 	return tf.state
 }
 
+// get last error caused connection to fail
+func (tf *TunnelForwarder) GetError() error {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+
+	return tf.lastErr
+}
+
+// check if connection can be retried, host key errors are permanent
+func (tf *TunnelForwarder) IsRetryable() bool {
+	var hostKeyErr *HostKeyError
+	return !errors.As(tf.GetError(), &hostKeyErr)
+}
+
 // get connection state in human readable format
 func (tf *TunnelForwarder) GetStateString() string {
-	switch tf.state {
+	switch tf.GetState() {
 	case Idle:
 		return "Idle"
 	case Connecting:
@@ -140,15 +203,223 @@ func (tf *TunnelForwarder) getListenerAddres() string {
 
 // set service address in tunnel client
 func (tf *TunnelForwarder) getServiceAddres() string {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+
 	return tf.service.host + ":" + tf.service.port
 }
 
+// change local service address without reconnecting, used by next accepted connections
+func (tf *TunnelForwarder) SetServiceAddress(host string, port string) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	tf.service.host = host
+	tf.service.port = port
+}
+
 // get status connection
 func (tf *TunnelForwarder) IsClosed() bool {
 	return tf.GetState() == ConnectionState(3)
 }
 
-func (tf *TunnelForwarder) ListenAndServe() error {
+// send keepalive@openssh.com until done, close the client when too many keepalives are missed
+func (tf *TunnelForwarder) keepalive(client *ssh.Client, done <-chan struct{}) {
+	interval := tf.tunnel.keepaliveInterval
+	if interval <= 0 {
+		return
+	}
+
+	maxMissed := tf.tunnel.keepaliveMaxMissed
+	if maxMissed <= 0 {
+		maxMissed = 3
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			// any reply, including failure, means the server is alive
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		select {
+		case <-done:
+			return
+		case err := <-reply:
+			if err != nil {
+				missed++
+			} else {
+				missed = 0
+			}
+		case <-time.After(interval):
+			missed++
+		}
+
+		if missed >= maxMissed {
+			err := fmt.Errorf("no keepalive reply from %s after %d attempts", tf.getTunnelAddres(), missed)
+			tf.setError(err)
+			tf.logger().Error("SSH connection is dead, closing", zap.Error(err))
+			client.Close()
+			return
+		}
+	}
+}
+
+// dial tunnel server, the handshake is aborted when context is cancelled or dial timeout passed
+func (tf *TunnelForwarder) dial(ctx context.Context) (*ssh.Client, error) {
+	timeout := tf.tunnel.dialTimeout
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+	dialer := net.Dialer{Timeout: timeout}
+
+	conn, err := dialer.DialContext(ctx, "tcp", tf.getTunnelAddres())
+	if err != nil {
+		return nil, err
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	// unresponsive server must not hang the handshake
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, tf.getTunnelAddres(), tf.getTunnelAuth())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(clientConn, chans, reqs), nil
+}
+
+// track active proxied connection, it is closed when forwarder stops
+func (tf *TunnelForwarder) track(conn net.Conn) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	// forwarder is stopping, do not let late connections keep it open
+	if tf.stopping {
+		conn.Close()
+		return
+	}
+
+	if tf.conns == nil {
+		tf.conns = make(map[net.Conn]struct{})
+	}
+	tf.conns[conn] = struct{}{}
+}
+
+// stop tracking proxied connection
+func (tf *TunnelForwarder) untrack(conn net.Conn) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	delete(tf.conns, conn)
+}
+
+// close every active proxied connection
+func (tf *TunnelForwarder) closeConnections() {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	tf.stopping = true
+	for conn := range tf.conns {
+		conn.Close()
+	}
+}
+
+// close write side of connection when supported
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+}
+
+// register proxy goroutine, refused when forwarder is draining
+func (tf *TunnelForwarder) startProxy() bool {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	if tf.draining {
+		return false
+	}
+
+	tf.active++
+	tf.wg.Add(1)
+
+	return true
+}
+
+// unregister proxy goroutine
+func (tf *TunnelForwarder) finishProxy() {
+	tf.mu.Lock()
+	tf.active--
+	tf.mu.Unlock()
+
+	tf.observer().ConnectionClosed(tf.id)
+
+	tf.wg.Done()
+}
+
+// proxy remote connection to local service
+func (tf *TunnelForwarder) proxy(remoteConn net.Conn) {
+	defer tf.finishProxy()
+
+	tf.track(remoteConn)
+	defer tf.untrack(remoteConn)
+	defer remoteConn.Close()
+
+	tf.logger().Info(fmt.Sprintf("Accepted remote connection from %s", remoteConn.RemoteAddr()))
+
+	// Dial the local service
+	localConn, err := net.Dial("tcp", tf.getServiceAddres())
+	if err != nil {
+		tf.observer().ServiceDialFailed(tf.id)
+		tf.logger().Error("Failed to dial service",
+			zap.Error(err),
+		)
+		return
+	}
+	tf.track(localConn)
+	defer tf.untrack(localConn)
+	defer localConn.Close()
+
+	tf.logger().Info(fmt.Sprintf("Connected to service at %s", tf.getServiceAddres()))
+
+	// Copy data between remote and local connections
+	// half-close each side once its source is done, so the peer sees EOF
+	observer := tf.observer()
+	done := make(chan struct{})
+	go func() {
+		io.Copy(countingWriter{remoteConn, func(n int) { observer.BytesOut(tf.id, n) }}, localConn)
+		closeWrite(remoteConn)
+		close(done)
+	}()
+	io.Copy(countingWriter{localConn, func(n int) { observer.BytesIn(tf.id, n) }}, remoteConn)
+	closeWrite(localConn)
+	<-done // Wait for the other copy to finish
+
+	tf.logger().Info(fmt.Sprintf("Connection closed for remote %s", remoteConn.RemoteAddr()))
+}
+
+// connect to tunnel server and forward remote connections to local service until
+// the connection is closed or context is cancelled, in-flight connections are waited before returning
+func (tf *TunnelForwarder) ListenAndServe(ctx context.Context) error {
 	if tf.listener == nil {
 		errMsg := "No listerner host and port set"
 		tf.logger().Error(errMsg)
@@ -161,27 +432,75 @@ func (tf *TunnelForwarder) ListenAndServe() error {
 		return errors.New(errMsg)
 	}
 
+	// Close cancels ctx, also while still dialing
+	parent := ctx
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	tf.mu.Lock()
+	if tf.closed {
+		tf.mu.Unlock()
+		return nil
+	}
+	tf.cancel = cancel
+	tf.mu.Unlock()
+
 	// Establish SSH connection
-	var err error
+	tf.setState(1)
+
+	started := time.Now()
+	sshClient, err := tf.dial(ctx)
+	if ctx.Err() == nil {
+		tf.observer().Dialed(tf.id, time.Since(started), err)
+	}
+
+	// agent is only needed during handshake
+	if tf.tunnel.agent != nil {
+		tf.tunnel.agent.Close()
+	}
 
-	tf.sshClient, err = ssh.Dial("tcp", tf.getTunnelAddres(), tf.getTunnelAuth())
 	if err != nil {
+		if ctx.Err() != nil {
+			tf.setState(3)
+			return parent.Err()
+		}
+
+		tf.setError(err)
 		tf.logger().Error("Failed to dial SSH server",
 			zap.Error(err),
 		)
 		return err
 	}
-	defer tf.sshClient.Close()
+	defer sshClient.Close()
+
+	// forwarder closed while handshake was finishing must not take the remote listener
+	tf.mu.Lock()
+	if tf.closed {
+		tf.state = Closed
+		tf.mu.Unlock()
+		return parent.Err()
+	}
+	tf.sshClient = sshClient
+	tf.state = Connected
+	tf.mu.Unlock()
 
-	// set connected state
-	tf.setState(2)
+	// close connection when context is cancelled
+	stop := context.AfterFunc(ctx, tf.Close)
+	defer stop()
+
+	keepaliveDone := make(chan struct{})
+	defer close(keepaliveDone)
+	go tf.keepalive(sshClient, keepaliveDone)
 
 	tf.logger().Info(fmt.Sprintf("SSH connection established to %s", tf.getTunnelAddres()))
 
 	// Listen on the remote server
-	listener, err := tf.sshClient.Listen(tf.getUnixOrTCP(), tf.getListenerAddres())
+	listener, err := sshClient.Listen(tf.getUnixOrTCP(), tf.getListenerAddres())
 	if err != nil {
-		tf.setState(4)
+		if tf.IsClosed() {
+			return parent.Err()
+		}
+		tf.setError(err)
 		tf.logger().Error("Failed to listen on remote server",
 			zap.Error(err),
 		)
@@ -189,14 +508,18 @@ func (tf *TunnelForwarder) ListenAndServe() error {
 	}
 	defer listener.Close()
 
+	tf.mu.Lock()
+	tf.remoteListener = listener
+	tf.mu.Unlock()
+
 	tf.logger().Info(fmt.Sprintf("Listening on remote server at %s. Forwarding to local service at %s", tf.getListenerAddres(), tf.getServiceAddres()))
 
 	for {
 		// Accept incoming connections on the remote listener
 		remoteConn, err := listener.Accept()
 		if err != nil {
-			// check if connection already close, break loop
-			if tf.IsClosed() {
+			// check if connection already close or dead, break loop
+			if tf.IsClosed() || tf.GetState() == Error {
 				break
 			}
 			// set connection status to closed
@@ -208,43 +531,79 @@ func (tf *TunnelForwarder) ListenAndServe() error {
 			continue
 		}
 
-		go func() {
-			defer remoteConn.Close()
+		if !tf.startProxy() {
+			remoteConn.Close()
+			continue
+		}
+		tf.observer().ConnectionAccepted(tf.id)
+		go tf.proxy(remoteConn)
+	}
 
-			tf.logger().Info(fmt.Sprintf("Accepted remote connection from %s", remoteConn.RemoteAddr()))
+	// ssh session is gone, nothing left to forward, unless in-flight connections are draining
+	if !tf.isDraining() {
+		tf.closeConnections()
+	}
+	tf.wg.Wait()
 
-			// Dial the local service
-			localConn, err := net.Dial("tcp", tf.getServiceAddres())
-			if err != nil {
-				tf.setState(4)
-				tf.logger().Error("Failed to dial service",
-					zap.Error(err),
-				)
-				return
-			}
-			defer localConn.Close()
+	return nil
+}
 
-			tf.logger().Info(fmt.Sprintf("Connected to service at %s", tf.getServiceAddres()))
+// check if forwarder is draining
+func (tf *TunnelForwarder) isDraining() bool {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
 
-			// Copy data between remote and local connections
-			done := make(chan struct{})
-			go func() {
-				io.Copy(remoteConn, localConn)
-				close(done)
-			}()
-			io.Copy(localConn, remoteConn)
-			<-done // Wait for the other copy to finish
+	return tf.draining
+}
 
-			tf.logger().Info(fmt.Sprintf("Connection closed for remote %s", remoteConn.RemoteAddr()))
-		}()
+// Shutdown stops accepting new connections and waits for in-flight connections until ctx is done,
+// the remaining ones are closed. It returns how many connections were drained and killed.
+func (tf *TunnelForwarder) Shutdown(ctx context.Context) (drained int, killed int) {
+	tf.mu.Lock()
+	tf.draining = true
+	tf.state = Closed
+	listener := tf.remoteListener
+	inflight := tf.active
+	tf.mu.Unlock()
+
+	if listener != nil {
+		listener.Close()
 	}
 
-	return nil
+	done := make(chan struct{})
+	go func() {
+		tf.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		tf.mu.RLock()
+		killed = tf.active
+		tf.mu.RUnlock()
+
+		tf.closeConnections()
+		<-done
+	}
+
+	tf.Close()
+
+	return inflight - killed, killed
 }
 
+// Close closes connection, a forwarder still dialing stops before listening on tunnel server
 func (tf *TunnelForwarder) Close() {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	tf.closed = true
+	if tf.cancel != nil {
+		tf.cancel()
+	}
+
 	if tf.sshClient != nil {
-		tf.setState(3)
+		tf.state = Closed
 		tf.sshClient.Close()
 	}
 }
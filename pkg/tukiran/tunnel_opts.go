@@ -1,6 +1,8 @@
 package tukiran
 
 import (
+	"time"
+
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 )
@@ -42,6 +44,21 @@ func WithTunnelAuthMethod(authMethod *ssh.ClientConfig) func(*TunnelForwarder) {
 	}
 }
 
+// set ssh-agent used by public key authentication, it is closed after the handshake
+func WithAgentAuth(agentAuth *AgentAuth) func(*TunnelForwarder) {
+	return func(tf *TunnelForwarder) {
+		tf.tunnel.agent = agentAuth
+	}
+}
+
+// set keepalive interval and how many missed replies before the connection is considered dead
+func WithKeepalive(interval time.Duration, maxMissed int) func(*TunnelForwarder) {
+	return func(tf *TunnelForwarder) {
+		tf.tunnel.keepaliveInterval = interval
+		tf.tunnel.keepaliveMaxMissed = maxMissed
+	}
+}
+
 // set listener host
 func WithListenerHost(host string) func(*TunnelForwarder) {
 	return func(tf *TunnelForwarder) {
@@ -76,3 +93,17 @@ func WithLogger(logger *zap.Logger) func(*TunnelForwarder) {
 		tf.zap = logger
 	}
 }
+
+// set observer receiving dial, connection and traffic events
+func WithObserver(observer Observer) func(*TunnelForwarder) {
+	return func(tf *TunnelForwarder) {
+		tf.events = observer
+	}
+}
+
+// set timeout of tcp dial and ssh handshake with tunnel server, default is 30 seconds
+func WithDialTimeout(timeout time.Duration) func(*TunnelForwarder) {
+	return func(tf *TunnelForwarder) {
+		tf.tunnel.dialTimeout = timeout
+	}
+}
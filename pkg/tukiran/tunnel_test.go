@@ -1,7 +1,17 @@
 package tukiran
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"strconv"
 	"testing"
+	"time"
+
+	gliderssh "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestIsListenerPortNumber_Valid(t *testing.T) {
@@ -11,3 +21,406 @@ func TestIsListenerPortNumber_Valid(t *testing.T) {
 		t.Fatalf("Server forwarding port is not set properly")
 	}
 }
+
+// start ssh server accepting any client, requests are passed to handleRequests
+func startTestSSHServer(t *testing.T, handleRequests func(<-chan *ssh.Request)) string {
+	t.Helper()
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate host key: %v", err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatalf("Failed to create host key signer: %v", err)
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				defer sshConn.Close()
+				go func() {
+					for newChannel := range chans {
+						newChannel.Reject(ssh.Prohibited, "no channels")
+					}
+				}()
+				handleRequests(reqs)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestKeepalive_DeadConnection(t *testing.T) {
+	// server reads requests but never replies, like a half-open connection
+	address := startTestSSHServer(t, func(reqs <-chan *ssh.Request) {
+		for range reqs {
+		}
+	})
+
+	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	tf := NewTunnelRemoteForwarder(WithKeepalive(10*time.Millisecond, 2))
+	tf.setState(2)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	finished := make(chan struct{})
+	go func() {
+		tf.keepalive(client, done)
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Keepalive did not detect dead connection")
+	}
+
+	if tf.GetState() != Error {
+		t.Fatalf("Expected Error state, got %s", tf.GetStateString())
+	}
+}
+
+func TestKeepalive_AliveConnection(t *testing.T) {
+	address := startTestSSHServer(t, func(reqs <-chan *ssh.Request) {
+		for req := range reqs {
+			req.Reply(false, nil)
+		}
+	})
+
+	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	tf := NewTunnelRemoteForwarder(WithKeepalive(10*time.Millisecond, 2))
+	tf.setState(2)
+
+	done := make(chan struct{})
+	go tf.keepalive(client, done)
+
+	time.Sleep(100 * time.Millisecond)
+	close(done)
+
+	if tf.GetState() != Connected {
+		t.Fatalf("Expected Connected state, got %s", tf.GetStateString())
+	}
+}
+
+// get a free local tcp port
+func freePort(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find free port: %v", err)
+	}
+	defer listener.Close()
+
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// listener delaying every accepted connection, the ssh handshake waits meanwhile
+type delayedListener struct {
+	net.Listener
+	delay time.Duration
+}
+
+func (l delayedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	time.Sleep(l.delay)
+	return conn, err
+}
+
+// start ssh server supporting remote port forwarding, returns its port
+func startTestTunnelServer(t *testing.T) string {
+	return startDelayedTunnelServer(t, 0)
+}
+
+// start ssh server supporting remote port forwarding answering handshake after delay, returns its port
+func startDelayedTunnelServer(t *testing.T, delay time.Duration) string {
+	t.Helper()
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	listener := delayedListener{tcpListener, delay}
+
+	forwardHandler := &gliderssh.ForwardedTCPHandler{}
+	server := &gliderssh.Server{
+		ReversePortForwardingCallback: func(ctx gliderssh.Context, host string, port uint32) bool {
+			return true
+		},
+		RequestHandlers: map[string]gliderssh.RequestHandler{
+			"tcpip-forward":        forwardHandler.HandleSSHRequest,
+			"cancel-tcpip-forward": forwardHandler.HandleSSHRequest,
+		},
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// start local tcp echo service, returns its port
+func startTestEchoService(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// wait until forwarder reaches state
+func waitForState(t *testing.T, tf *TunnelForwarder, state ConnectionState) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for tf.GetState() != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for state, current state %s", tf.GetStateString())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// wait until forwarder listens on tunnel server, Connected is set before remote listener is requested
+func waitForListener(t *testing.T, tf *TunnelForwarder) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tf.mu.RLock()
+		listening := tf.remoteListener != nil
+		tf.mu.RUnlock()
+		if listening {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for remote listener, current state %s", tf.GetStateString())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestListenAndServe_ContextCancel(t *testing.T) {
+	listenerPort := freePort(t)
+	tf := NewTunnelRemoteForwarder(
+		WithConnectionID("test"),
+		WithTunnelHost("127.0.0.1"),
+		WithTunnelPort(startTestTunnelServer(t)),
+		WithTunnelAuthMethod(&ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()}),
+		WithListenerHost("127.0.0.1"),
+		WithListenerPort(listenerPort),
+		WithServiceHost("127.0.0.1"),
+		WithServicePort(startTestEchoService(t)),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- tf.ListenAndServe(ctx)
+	}()
+	waitForListener(t, tf)
+
+	// open a connection through the tunnel and keep it in-flight
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+listenerPort, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial tunnel listener: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("Expected echo reply, got %q (%v)", reply, err)
+	}
+
+	cancel()
+
+	select {
+	case <-result:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ListenAndServe did not return after context cancel")
+	}
+
+	if tf.GetState() != Closed {
+		t.Fatalf("Expected Closed state, got %s", tf.GetStateString())
+	}
+}
+
+func TestShutdown_DrainAndKill(t *testing.T) {
+	listenerPort := freePort(t)
+	tf := NewTunnelRemoteForwarder(
+		WithConnectionID("test"),
+		WithTunnelHost("127.0.0.1"),
+		WithTunnelPort(startTestTunnelServer(t)),
+		WithTunnelAuthMethod(&ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()}),
+		WithListenerHost("127.0.0.1"),
+		WithListenerPort(listenerPort),
+		WithServiceHost("127.0.0.1"),
+		WithServicePort(startTestEchoService(t)),
+	)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- tf.ListenAndServe(context.Background())
+	}()
+	waitForListener(t, tf)
+
+	dial := func() net.Conn {
+		conn, err := net.DialTimeout("tcp", "127.0.0.1:"+listenerPort, 5*time.Second)
+		if err != nil {
+			t.Fatalf("Failed to dial tunnel listener: %v", err)
+		}
+		conn.Write([]byte("ping"))
+		io.ReadFull(conn, make([]byte, 4))
+		return conn
+	}
+
+	// first connection finishes on its own while draining, second one stays open
+	finishing := dial()
+	stuck := dial()
+	defer stuck.Close()
+
+	time.AfterFunc(100*time.Millisecond, func() {
+		finishing.Close()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	drained, killed := tf.Shutdown(ctx)
+	if drained != 1 || killed != 1 {
+		t.Fatalf("Expected 1 drained and 1 killed, got %d drained and %d killed", drained, killed)
+	}
+
+	select {
+	case <-result:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ListenAndServe did not return after shutdown")
+	}
+}
+
+func TestClose_WhileConnecting(t *testing.T) {
+	listenerPort := freePort(t)
+	tf := NewTunnelRemoteForwarder(
+		WithConnectionID("test"),
+		WithTunnelHost("127.0.0.1"),
+		WithTunnelPort(startDelayedTunnelServer(t, 300*time.Millisecond)),
+		WithTunnelAuthMethod(&ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()}),
+		WithListenerHost("127.0.0.1"),
+		WithListenerPort(listenerPort),
+		WithServiceHost("127.0.0.1"),
+		WithServicePort(startTestEchoService(t)),
+	)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- tf.ListenAndServe(context.Background())
+	}()
+	waitForState(t, tf, Connecting)
+
+	tf.Close()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ListenAndServe did not return after close while connecting")
+	}
+
+	// give a late handshake the chance to listen before checking
+	time.Sleep(500 * time.Millisecond)
+	if tf.GetState() != Closed {
+		t.Fatalf("Expected Closed state, got %s", tf.GetStateString())
+	}
+	if conn, err := net.DialTimeout("tcp", "127.0.0.1:"+listenerPort, time.Second); err == nil {
+		conn.Close()
+		t.Fatalf("Expected closed forwarder not to listen on tunnel server")
+	}
+
+	// closed forwarder is never started again
+	if err := tf.ListenAndServe(context.Background()); err != nil || tf.GetState() != Closed {
+		t.Fatalf("Expected closed forwarder to stay closed, got %s (%v)", tf.GetStateString(), err)
+	}
+}
+
+func TestListenAndServe_HandshakeTimeout(t *testing.T) {
+	// server accepts tcp but never answers the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	tf := NewTunnelRemoteForwarder(
+		WithTunnelHost("127.0.0.1"),
+		WithTunnelPort(strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)),
+		WithTunnelAuthMethod(&ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()}),
+		WithDialTimeout(100*time.Millisecond),
+	)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- tf.ListenAndServe(context.Background())
+	}()
+
+	select {
+	case err := <-result:
+		if err == nil || tf.GetState() != Error {
+			t.Fatalf("Expected handshake timeout error, got %s (%v)", tf.GetStateString(), err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Handshake did not time out")
+	}
+}